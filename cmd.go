@@ -8,20 +8,74 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
+	"github.com/lorenzb/goprofile/instrument"
 	shellwords "github.com/mattn/go-shellwords"
 )
 
 // command line options
 var options struct {
-	InPlace    bool
-	PrintWork  bool
-	Verbose    bool
-	Output     string
-	ProfFile   string
-	BuildFlags []string
+	// Run is set for 'goprofile run'.
+	Run bool
+	// Report is set for 'goprofile report'.
+	Report bool
+	// Revert is set for 'goprofile revert'.
+	Revert bool
+	// DryRun is set if build only prints what it would do (-n). With
+	// Diff, it prints the changes to the source files as well.
+	DryRun bool
+	Diff   bool
+	// Strip is set if the code and files added by goprofile are to be
+	// removed from the given files or package (see stripPackage).
+	Strip bool
+	// Args are the source files or the package given on the command line.
+	Args []string
+	// RunArgs are the arguments passed to the program by 'goprofile run'.
+	RunArgs []string
+	// Tool is the path of the go tool to run if goprofile was run by the
+	// go command with -toolexec (see toolexec), and ToolArgs are the
+	// arguments of the tool.
+	Tool          string
+	ToolArgs      []string
+	Top           int
+	Focus         string
+	Ignore        string
+	HideGoprofile bool
+	SampleType    string
+	InPlace       bool
+	Overlay       bool
+	PrintWork     bool
+	Verbose       bool
+	Output        string
+	ProfFile      string
+	Profiles      []string
+	Trace         bool
+	BuildFlags    []string
+	// Interval, Keep and KeepSize configure periodic snapshots
+	// (see instrument.SupportConfig).
+	Interval time.Duration
+	Keep     int
+	KeepSize int64
+	// CPURate is the rate of the cpu profile in Hz.
+	CPURate int
+	// Delay and Duration limit profiling to a window of the
+	// program's run time (see instrument.SupportConfig).
+	Delay    time.Duration
+	Duration time.Duration
+	// ToggleSignal is the signal toggling the cpu profile with -toggle
+	// (see instrument.SupportConfig).
+	ToggleSignal string
+	// HTTP is the address to serve profiles at.
+	HTTP string
+	// Init is set if profiling starts before the packages of the
+	// program are initialized (see initPackage).
+	Init bool
+	// Label selects the functions to label with pprof labels
+	// (nil if -label isn't given).
+	Label *regexp.Regexp
 }
 
 var flags flag.FlagSet
@@ -30,19 +84,62 @@ var flags flag.FlagSet
 // exit code. After argument parsing, main calls run() to do all the actual work.
 func main() {
 	var buildFlags string
+	var profiles string
+	var label string
+	var keepSize string
+	var toggle bool
+	var toggleSignal string
 	var help bool
 
 	flags.Init(os.Args[0], flag.ContinueOnError)
-	flags.StringVar(&buildFlags, "buildflags", "", "arguments to pass on to the underlying invocation of 'go build'")
+	flags.StringVar(&buildFlags, "buildflags", "", "arguments to pass on to the underlying invocation of 'go build'\n    \t(or 'go list' with -toolexec)")
+	flags.IntVar(&options.CPURate, "cpurate", 0, "sampling rate of the cpu profile in Hz (default: pprof's 100 Hz)")
+	flags.DurationVar(&options.Delay, "delay", 0, "start profiling this long after the program started (e.g. 10s)")
+	flags.DurationVar(&options.Duration, "duration", 0, "stop profiling and write the profiles after profiling this long (e.g. 30s), \n    \twhile the program keeps running")
+	flags.BoolVar(&options.Diff, "diff", false, "like -n, but also print a unified diff of the changes to each instrumented source file")
+	flags.StringVar(&options.Focus, "focus", "", "only consider samples with a function matching this regexp on their stack \n    \t(goprofile report and goprofile run)")
 	flags.BoolVar(&help, "h", false, "")
 	flags.BoolVar(&help, "help", false, "show help")
-	flags.BoolVar(&options.InPlace, "inplace", false, "perform instrumentation in-place \n    \tDANGER: This will overwrite your source files! \n    \tOnly use this if your files are under version control.")
-	flags.StringVar(&options.Output, "o", "", "path to instrumented output binary")
-	flags.StringVar(&options.ProfFile, "p", "", "path to profiling output")
+	flags.StringVar(&options.HTTP, "http", "", "serve profiles like net/http/pprof at this address, e.g. localhost:6060 \n    \tor unix:/tmp/app.sock (on a private ServeMux)")
+	flags.BoolVar(&options.HideGoprofile, "hidegoprofile", true, "hide the stack frames of the code added by goprofile \n    \t(goprofile report and goprofile run)")
+	flags.DurationVar(&options.Interval, "interval", 0, "write the profiles to a new set of files every interval (e.g. 60s) \n    \tinstead of only when the program exits")
+	flags.StringVar(&options.Ignore, "ignore", "", "ignore samples with a function matching this regexp on their stack \n    \t(goprofile report and goprofile run)")
+	flags.BoolVar(&options.Init, "init", false, "start profiling before the imported packages are initialized, so that \n    \tinit functions and package-level variables show up in the profiles")
+	flags.BoolVar(&options.InPlace, "inplace", false, "perform instrumentation in-place \n    \tDANGER: This will overwrite your source files! \n    \tUse 'goprofile revert' to restore them.")
+	flags.BoolVar(&options.Overlay, "overlay", false, "build the package in place, passing the instrumented files to 'go build' \n    \tthrough an -overlay file instead of copying the package to the work directory")
+	flags.IntVar(&options.Keep, "keep", 0, "number of intervals whose profiles are kept with -interval (0 keeps all)")
+	flags.StringVar(&keepSize, "keepsize", "", "maximum total size of the profiles kept with -interval, e.g. 500MB \n    \t(default: no limit)")
+	flags.StringVar(&label, "label", "", "label the goroutines executing functions whose name matches this regexp \n    \t(e.g. 'main\\.\\(\\*server\\)\\.handle') with the pprof label func=<function name>")
+	flags.BoolVar(&options.DryRun, "n", false, "print the 'go build' command that would be run and the files that would be written, \n    \twithout writing any file or building")
+	flags.StringVar(&options.Output, "o", "", "path to instrumented output binary \n    \t(or a directory to write it to, e.g. bin/)")
+	flags.StringVar(&options.ProfFile, "p", "", "path to profiling output \n    \t(or a directory to write it to, e.g. profiles/)")
+	flags.StringVar(&profiles, "profiles", "cpu", "comma separated list of profiles to collect \n    \t(cpu, heap, allocs, block, mutex, goroutine, threadcreate; none with -http)")
+	flags.BoolVar(&options.Strip, "strip", false, "remove the code and files goprofile added to the given files or package \n    \t(e.g. with -inplace) instead of instrumenting them")
+	flags.StringVar(&options.SampleType, "sample", "", "sample type to report, e.g. alloc_space for heap profiles \n    \t(goprofile report and goprofile run; default: the profile's default type)")
+	flags.IntVar(&options.Top, "top", 10, "number of entries in the tables printed by goprofile report and goprofile run \n    \t(0 disables the summary printed by goprofile run)")
+	flags.BoolVar(&toggle, "toggle", false, "don't collect the cpu profile from the start, but toggle it with a signal \n    \t(see -togglesignal); heap, goroutine and the other selected profiles \n    \tare written on each signal")
+	flags.StringVar(&toggleSignal, "togglesignal", "USR1", "signal toggling the cpu profile with -toggle (USR1, USR2 or HUP)")
+	flags.BoolVar(&options.Trace, "trace", false, "additionally write an execution trace for 'go tool trace'")
 	flags.BoolVar(&options.Verbose, "v", false, "")
 	flags.BoolVar(&options.Verbose, "verbose", false, "print verbose output")
-	flags.BoolVar(&options.PrintWork, "work", false, "print the name of the temporary work directory")
-	flags.Parse(os.Args[1:])
+	flags.BoolVar(&options.PrintWork, "work", false, "print the name of the temporary work directory and do not delete it when exiting")
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "run" {
+		options.Run = true
+		args = args[1:]
+	} else if len(args) > 0 && args[0] == "report" {
+		options.Report = true
+		args = args[1:]
+	} else if len(args) > 0 && args[0] == "revert" {
+		options.Revert = true
+		args = args[1:]
+	}
+	flags.Parse(args)
+	if !options.Run && !options.Report && !options.Revert && flags.NArg() > 0 && isTool(flags.Arg(0)) {
+		options.Tool, options.ToolArgs = flags.Arg(0), flags.Args()[1:]
+	} else {
+		options.Args, options.RunArgs = splitArgs(flags.Args())
+	}
 
 	var err error
 	options.BuildFlags, err = shellwords.Parse(buildFlags)
@@ -51,11 +148,104 @@ func main() {
 		os.Exit(1)
 	}
 
+	options.Profiles, err = parseProfiles(profiles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to parse given profiles.", err)
+		os.Exit(1)
+	}
+
+	if len(options.Profiles) == 0 && options.HTTP == "" && !options.Trace {
+		fmt.Fprintln(os.Stderr, "No profiles selected. -profiles none requires -http or -trace.")
+		os.Exit(1)
+	}
+
+	if options.Interval != 0 && options.Interval < time.Second {
+		fmt.Fprintln(os.Stderr, "Interval must be at least 1s.")
+		os.Exit(1)
+	}
+
+	if options.CPURate < 0 {
+		fmt.Fprintln(os.Stderr, "The cpu profile rate must not be negative.")
+		os.Exit(1)
+	}
+
+	if (options.Delay != 0 || options.Duration != 0) && (options.Interval != 0 || toggle) {
+		fmt.Fprintln(os.Stderr, "-delay and -duration can't be combined with -interval or -toggle.")
+		os.Exit(1)
+	}
+
+	if options.Diff {
+		options.DryRun = true
+	}
+	if options.DryRun && options.Strip {
+		fmt.Fprintln(os.Stderr, "-n and -diff can't be combined with -strip.")
+		os.Exit(1)
+	}
+
+	if options.Init && (options.Delay != 0 || toggle) {
+		fmt.Fprintln(os.Stderr, "-init can't be combined with -delay or -toggle.")
+		os.Exit(1)
+	}
+
+	if toggle {
+		if options.Interval != 0 {
+			fmt.Fprintln(os.Stderr, "-toggle and -interval can't be combined.")
+			os.Exit(1)
+		}
+		cpu := false
+		for _, kind := range options.Profiles {
+			cpu = cpu || kind == "cpu"
+		}
+		if !cpu {
+			fmt.Fprintln(os.Stderr, "-toggle requires the cpu profile to be selected with -profiles.")
+			os.Exit(1)
+		}
+		options.ToggleSignal, err = parseToggleSignal(toggleSignal)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to parse given togglesignal.", err)
+			os.Exit(1)
+		}
+	}
+
+	if keepSize != "" {
+		options.KeepSize, err = parseSize(keepSize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to parse given keepsize.", err)
+			os.Exit(1)
+		}
+	}
+
+	if label != "" {
+		options.Label, err = regexp.Compile(label)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to parse given label regexp.", err)
+			os.Exit(1)
+		}
+	}
+
+	if options.Tool != "" {
+		var unsupported []string
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "diff", "init", "inplace", "n", "o", "overlay", "strip", "work":
+				unsupported = append(unsupported, "-"+f.Name)
+			}
+		})
+		if len(unsupported) > 0 {
+			fmt.Fprintln(os.Stderr, strings.Join(unsupported, ", "), "can't be used with go build -toolexec.")
+			os.Exit(1)
+		}
+	}
+
 	if help {
 		h := func(args ...interface{}) {
 			fmt.Fprintln(os.Stderr, args...)
 		}
-		h(`Usage: goprofile [-o output binary] [-p profile] [source files... | package]`)
+		h(`Usage: goprofile [-o output binary] [-p profile] [source files... | package | patterns...]`)
+		h(`       goprofile run [flags] [source files... | package] [-- arguments...]`)
+		h(`       goprofile report [flags] <profile> [binary]`)
+		h(`       goprofile revert [package | directory]`)
+		h(`       go build -toolexec='goprofile [flags]' [build flags] [packages]`)
 		h()
 		h(`Rule of thumb: 'go build' + profiling instrumentation = goprofile.`)
 		h()
@@ -63,6 +253,12 @@ func main() {
 		h(`The instrumented binary is like the vanilla binary created by 'go build' but`)
 		h(`outputs profiling information.`)
 		h(``)
+		h(`goprofile run builds the instrumented binary, runs it with the arguments given`)
+		h(`after '--' and prints the top entries of the collected profile.`)
+		h(`goprofile report prints the top functions of a profile without the Go toolchain.`)
+		h(`goprofile revert undoes instrumenting a package with -inplace.`)
+		h(`With go build -toolexec, the go command builds instrumented main packages.`)
+		h(``)
 		h(`If no source files or package are specified, goprofile will attempt to treat`)
 		h(`the current directory as a package.`)
 		h()
@@ -82,9 +278,20 @@ func main() {
 		h(`    goprofile -p ~/trace.pprof module/path/of/your/complexapp`)
 		h(`    # copy file complexapp.profile to the server`)
 		h(`    # on the server, execute your complexapp.profile binary`)
+		h(`    # (set GOPROFILE_OUT to write the profile elsewhere without rebuilding)`)
 		h(`    # copy the ~/trace.pprof from your server to your local machine`)
 		h(`    go tool pprof complexapp.profile trace.pprof`)
 		h(``)
+		h(`3)`)
+		h(`You want a quick look at where your program spends its time when it's run`)
+		h(`with the arguments "-n 1000". You run`)
+		h(`    goprofile run -top 20 ./cmd/myprogram -- -n 1000`)
+		h(``)
+		h(`4)`)
+		h(`You want to profile all commands of your repository. You run`)
+		h(`    goprofile -o bin/ ./cmd/...`)
+		h(`    # run e.g. bin/server.profile, which writes server.pprof`)
+		h(``)
 		h(`Details:`)
 		h(`If goprofile receives multiple source files as arguments`)
 		h(`(e.g. goprofile foo.go cmd.go), it will name the output after the first file `)
@@ -92,15 +299,40 @@ func main() {
 		h(`last element of the package path. If nothing is passed, goprofile will name`)
 		h(`the output after the current working directory.`)
 		h(``)
+		h(`See https://github.com/lorenzb/goprofile for how each mode and flag works.`)
 		return
 	}
 
-	if err := run(); err != nil {
+	if options.Tool != "" {
+		err = toolexec()
+	} else if options.Report {
+		err = report(options.Args)
+	} else if options.Revert {
+		err = revert(options.Args)
+	} else {
+		err = run()
+	}
+	if err != nil {
+		if exit, ok := err.(programExit); ok {
+			os.Exit(exit.code)
+		}
 		fmt.Fprintln(os.Stderr, "Fatal:", err)
 		os.Exit(1)
 	}
 }
 
+// splitArgs splits the positional command line arguments at the
+// first "--" into the source files or package to build and the
+// arguments for 'goprofile run' to pass to the program.
+func splitArgs(args []string) (buildArgs, runArgs []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
+
 // isRelevant decides whether a file is relevant to 'go build'.
 func isRelevant(name string) bool {
 	if name[0] == '.' {
@@ -117,52 +349,76 @@ func isRelevant(name string) bool {
 	return false
 }
 
+// packageFiles returns the files in the directory of the package
+// that are relevant to 'go build'.
+func packageFiles(pkg *goPackage) ([]string, error) {
+	fd, err := os.Open(pkg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	var relevantPaths []string
+	fis, err := fd.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if fi.IsDir() || !isRelevant(fi.Name()) {
+			continue
+		}
+		// go files excluded from the build are neither instrumented nor copied
+		if !strings.HasSuffix(fi.Name(), ".go") || pkg.includes(fi.Name()) {
+			relevantPaths = append(relevantPaths, filepath.Join(pkg.Dir, fi.Name()))
+		}
+	}
+	return relevantPaths, nil
+}
+
 // fileset computes the set of files to be instrumented/copied
 // from the arguments passed to the program.
 //
 // paths is the set of files. list is a boolean indicating whether
 // the set of files was explicitly listed on the command line
-// (e.g. "goprofile foo.go bla.go").
-func fileset() (paths []string, list bool, err error) {
-	dir := func(path string) ([]string, bool, error) {
-		fd, err := os.Open(path)
-		if err != nil {
-			return nil, false, err
-		}
-		var relevantPaths []string
-		fis, err := fd.Readdir(-1)
+// (e.g. "goprofile foo.go bla.go"). pkg describes the package
+// the files belong to, as reported by 'go list'.
+func fileset() (paths []string, list bool, pkg *goPackage, err error) {
+	dir := func(pkg *goPackage) ([]string, bool, *goPackage, error) {
+		paths, err := packageFiles(pkg)
 		if err != nil {
-			return nil, false, err
-		}
-		for _, fi := range fis {
-			if !fi.IsDir() && isRelevant(fi.Name()) {
-				relevantPaths = append(relevantPaths, filepath.Join(path, fi.Name()))
-			}
+			return nil, false, nil, err
 		}
-		return relevantPaths, false, nil
+		return paths, false, pkg, nil
 	}
 
-	switch len(flags.Args()) {
+	switch len(options.Args) {
 	case 0:
-		return dir(".")
+		pkg, err := listPackage(".")
+		if err != nil {
+			return nil, false, nil, err
+		}
+		return dir(pkg)
 	case 1:
-		fi, err := os.Stat(flags.Arg(0))
+		fi, err := os.Stat(options.Args[0])
 		if err == nil && !fi.IsDir() {
-			return flags.Args(), true, nil
+			pkg, err := listPackage(options.Args...)
+			if err != nil {
+				return nil, true, nil, err
+			}
+			return options.Args, true, pkg, nil
 		} else {
-			gopath := os.Getenv("GOPATH")
-			if gopath == "" {
-				return nil, false, errors.New("Empty GOPATH environment variable")
+			pkg, err := listPackage(options.Args[0])
+			if err != nil {
+				return nil, false, nil, err
 			}
-			return dir(filepath.Join(gopath, "src", flags.Arg(0)))
+			return dir(pkg)
 		}
 	default:
 		var paths []string
 		var dir string
-		for _, arg := range flags.Args() {
+		for _, arg := range options.Args {
 			_, err := os.Stat(arg)
 			if err != nil {
-				return nil, true, err
+				return nil, true, nil, err
 			}
 			if dir == "" {
 				dir = filepath.Dir(arg)
@@ -170,28 +426,31 @@ func fileset() (paths []string, list bool, err error) {
 			if dir != filepath.Dir(arg) {
 				err := fmt.Errorf("named files must all be in one directory; have '%s' and '%s'",
 					dir, filepath.Dir(arg))
-				return nil, false, err
+				return nil, false, nil, err
 			}
 			paths = append(paths, arg)
 		}
-		return paths, true, nil
+		pkg, err := listPackage(paths...)
+		if err != nil {
+			return nil, true, nil, err
+		}
+		return paths, true, pkg, nil
 	}
 }
 
 // outputName returns the name of the executable
 // that 'go build' would build with the given arguments.
-func outputName() (string, error) {
-	switch len(flags.Args()) {
+func outputName(pkg *goPackage) (string, error) {
+	switch len(options.Args) {
 	case 0:
-		wd, err := os.Getwd()
-		if err != nil {
-			return "", err
-		}
-		return filepath.Base(wd), nil
+		return pkg.binaryName(), nil
 	case 1:
+		if fi, err := os.Stat(options.Args[0]); err != nil || fi.IsDir() {
+			return pkg.binaryName(), nil
+		}
 		fallthrough
 	default:
-		name := filepath.Base(flags.Arg(0))
+		name := filepath.Base(options.Args[0])
 		if strings.Contains(name, ".") {
 			end := strings.LastIndex(name, ".")
 			return name[:end], nil
@@ -204,19 +463,26 @@ func outputName() (string, error) {
 // makeWorkdir returns the path to the directory in which go profile
 // should store the instrumented source files. If the directory does
 // not exist, makeWorkdir creates it.
-func makeWorkdir() (string, error) {
+//
+// If the package is part of a module and the package is built by
+// copying it to the directory, the directory is created inside
+// the package's directory, so that the go command finds the module's
+// go.mod (including any replace directives) and its other packages.
+// The name of the directory starts with an underscore, so that
+// patterns like "./..." don't match it.
+func makeWorkdir(pkg *goPackage) (string, error) {
 	var dir string
 	var err error
 
 	if options.InPlace {
-		dir = "."
-	} else {
-		dir, err = ioutil.TempDir("", "goprofile")
+		dir = pkg.Dir
+	} else if pkg.Module != nil && !options.Overlay {
+		dir, err = ioutil.TempDir(pkg.Dir, "_goprofile")
 		if err != nil {
 			return "", err
 		}
-		dir = filepath.Join(dir, time.Now().Format("2006-02-01T15_04_05"))
-		err = os.MkdirAll(dir, 0700)
+	} else {
+		dir, err = ioutil.TempDir("", "goprofile")
 		if err != nil {
 			return "", err
 		}
@@ -227,84 +493,641 @@ func makeWorkdir() (string, error) {
 	return dir, nil
 }
 
-func run() error {
-	workdir, err := makeWorkdir()
+// initPackage returns the directory of the package added with -init (see
+// instrument.InitPackageDir) and the path under which the instrumented
+// package and the packages it imports (see initImporters) import it. In a
+// module, it is placed at the root of the module. In GOPATH mode, it is placed
+// next to the instrumented files, and imported by a relative path if these
+// aren't part of the GOPATH (e.g. when copied to the work directory); the go
+// command rejects relative imports inside the GOPATH.
+func initPackage(pkg *goPackage, list bool, workdir, prefix string) (dir, importPath string) {
+	name := instrument.InitPackageDir(prefix)
+	if pkg.Module != nil {
+		return filepath.Join(pkg.Module.Dir, name), pkg.Module.Path + "/" + name
+	}
+	dir = filepath.Join(pkg.Dir, name)
+	if !list && pkg.ImportPath != "" && !strings.HasPrefix(pkg.ImportPath, "_") {
+		return dir, pkg.ImportPath + "/" + name
+	}
+	// Files given on the command line are listed as "command-line-arguments",
+	// even if they are part of the GOPATH.
+	if importPath := gopathImportPath(pkg.Dir); importPath != "" {
+		return dir, importPath + "/" + name
+	}
+	if !options.InPlace && !options.Overlay {
+		return filepath.Join(workdir, name), "./" + name
+	}
+	return dir, "./" + name
+}
+
+// initImporters returns the packages that the given files of pkg import
+// (directly or indirectly) and that have to import the package added with
+// -init, whose import path is initPath: Go initializes a package only after the
+// packages it imports. The packages of the standard library and of modules in
+// the module cache, which can't be changed, are left out, and so are all
+// packages if the init package is imported by a relative path.
+func initImporters(paths []string, list bool, pkg *goPackage, initPath string) ([]*goPackage, error) {
+	if strings.HasPrefix(initPath, "./") {
+		return nil, nil
+	}
+	args := []string{"-deps", pkg.Dir}
+	if list {
+		args = append(args[:1], paths...)
+	}
+	deps, err := listPackages(args...)
 	if err != nil {
+		return nil, err
+	}
+	var importers []*goPackage
+	for _, dep := range deps {
+		if dep.Standard || dep.Name == "main" || dep.ImportPath == initPath {
+			continue
+		}
+		if m := dep.Module; m != nil && !m.Main && (m.Replace == nil || m.Replace.Version != "") {
+			continue
+		}
+		importers = append(importers, dep)
+	}
+	return importers, nil
+}
+
+// An addedFile is a file that goprofile adds to the program.
+type addedFile struct {
+	path string
+	src  []byte
+}
+
+// initFiles returns the import path of the package added with -init to the
+// program built from the given files of pkg (see initPackage) and the files
+// to add: the file of the package and the files making the packages of the
+// program import it (see initImporters). config is the configuration of the
+// support file.
+func initFiles(paths []string, list bool, pkg *goPackage, workdir string, config instrument.SupportConfig) (string, []addedFile, error) {
+	dir, importPath := initPackage(pkg, list, workdir, config.Prefix)
+	importers, err := initImporters(paths, list, pkg, importPath)
+	if err != nil {
+		return "", nil, err
+	}
+	src, err := instrument.InitSource(config)
+	if err != nil {
+		return "", nil, err
+	}
+	files := []addedFile{{filepath.Join(dir, instrument.InitFileName), src}}
+	for _, importer := range importers {
+		path := filepath.Join(importer.Dir, instrument.InitImportFileName(config.Prefix))
+		if _, err := os.Stat(path); err == nil {
+			// left behind by goprofile -inplace
+			if generated, err := generatedFiles([]string{path}); err != nil || len(generated) == 0 {
+				return "", nil, fmt.Errorf("Failed to add %s: file exists", path)
+			}
+		}
+		src, err := instrument.InitImportSource(importer.Name, importPath)
+		if err != nil {
+			return "", nil, err
+		}
+		files = append(files, addedFile{path, src})
+	}
+	return importPath, files, nil
+}
+
+// initOverlaid determines whether the files added with -init for the init
+// package with the import path initPath are only added in the overlay of the
+// build. Otherwise they are written to the source tree with -inplace, or to the
+// work directory if the package is imported by a relative path from there.
+func initOverlaid(initPath string) bool {
+	return !options.InPlace && (options.Overlay || !strings.HasPrefix(initPath, "./"))
+}
+
+// addInitFiles adds the files added with -init (see initFiles) for the init
+// package with the import path initPath. With -inplace, they are recorded in
+// the manifest m. If they are only added in the overlay (see initOverlaid),
+// they are written to a directory named like the init package in workdir.
+func addInitFiles(files []addedFile, initPath, workdir string, overlay map[string]string, m *manifest) error {
+	if !initOverlaid(initPath) {
+		dir := filepath.Dir(files[0].path)
+		if options.InPlace {
+			if _, err := os.Stat(dir); os.IsNotExist(err) {
+				if err := m.createDir(dir); err != nil {
+					return err
+				}
+			}
+		}
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := writeGenerated(f.path, f.src, "init package", options.InPlace); err != nil {
+				return err
+			}
+			if options.InPlace {
+				if err := m.create(f.path); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	dir := filepath.Join(workdir, filepath.Base(filepath.Dir(files[0].path)))
+	if err := os.MkdirAll(dir, 0777); err != nil {
 		return err
 	}
+	for i, f := range files {
+		to := filepath.Join(dir, fmt.Sprintf("%d_%s", i, filepath.Base(f.path)))
+		if err := writeGenerated(to, f.src, "init package", false); err != nil {
+			return err
+		}
+		overlay[f.path] = to
+	}
+	return nil
+}
 
-	wd, err := os.Getwd()
+// isPattern determines whether any of the arguments is a package
+// pattern like "./cmd/...".
+func isPattern(args []string) bool {
+	for _, arg := range args {
+		if strings.Contains(arg, "...") {
+			return true
+		}
+	}
+	return false
+}
+
+// isDirArg determines whether a path given with -o or -p names a
+// directory, i.e. whether it ends in a path separator or is an
+// existing directory.
+func isDirArg(path string) bool {
+	if strings.HasSuffix(path, "/") || strings.HasSuffix(path, string(filepath.Separator)) {
+		return true
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+func run() error {
+	if isPattern(options.Args) {
+		return runPatterns()
+	}
+
+	paths, list, pkg, err := fileset()
 	if err != nil {
 		return err
 	}
+	if options.Strip {
+		return stripPackage(paths, pkg)
+	}
+	name, err := outputName(pkg)
+	if err != nil {
+		return err
+	}
+	return build(paths, list, pkg, name)
+}
 
-	paths, list, err := fileset()
+// runPatterns instruments every main package matched by the package
+// patterns given on the command line (e.g. "./cmd/...") independently.
+func runPatterns() error {
+	if options.Run {
+		return errors.New("goprofile run doesn't support package patterns")
+	}
+
+	pkgs, err := listPackages(options.Args...)
 	if err != nil {
 		return err
 	}
+	var mains []*goPackage
+	names := make(map[string]string)
+	for _, pkg := range pkgs {
+		if pkg.Name != "main" {
+			continue
+		}
+		name := pkg.binaryName()
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("%s and %s would both be named %s", other, pkg.ImportPath, name)
+		}
+		names[name] = pkg.ImportPath
+		mains = append(mains, pkg)
+	}
+	if len(mains) == 0 {
+		return fmt.Errorf("%s matches no main packages", strings.Join(options.Args, " "))
+	}
+	if len(mains) > 1 {
+		if options.Output != "" && !isDirArg(options.Output) {
+			return errors.New("-o must be a directory (e.g. -o bin/) when instrumenting multiple commands")
+		}
+		if options.ProfFile != "" && !isDirArg(options.ProfFile) {
+			return errors.New("-p must be a directory (e.g. -p profiles/) when instrumenting multiple commands")
+		}
+	}
+
+	for _, pkg := range mains {
+		if options.Verbose {
+			fmt.Fprintln(os.Stderr, "Instrumenting", pkg.ImportPath)
+		}
+		paths, err := packageFiles(pkg)
+		if err != nil {
+			return err
+		}
+		if options.Strip {
+			err = stripPackage(paths, pkg)
+		} else {
+			err = build(paths, false, pkg, pkg.binaryName())
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", pkg.ImportPath, err)
+		}
+	}
+	return nil
+}
+
+// without returns the paths that aren't in remove.
+func without(paths, remove []string) []string {
+	var kept []string
+	for _, path := range paths {
+		found := false
+		for _, r := range remove {
+			found = found || path == r
+		}
+		if !found {
+			kept = append(kept, path)
+		}
+	}
+	return kept
+}
 
-	name, err := outputName()
+// stripPackage removes the code injected by goprofile from the given files of
+// pkg, as well as the files goprofile added to the package: support files, the
+// package added with -init and the files importing it in the packages the
+// program imports, and the manifest written with -inplace.
+func stripPackage(paths []string, pkg *goPackage) error {
+	fis, err := ioutil.ReadDir(pkg.Dir)
 	if err != nil {
 		return err
 	}
+	var goFiles []string
+	for _, fi := range fis {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".go") {
+			goFiles = append(goFiles, filepath.Join(pkg.Dir, fi.Name()))
+		}
+	}
+	generated, err := generatedFiles(goFiles)
+	if err != nil {
+		return err
+	}
+	var initFiles []string
+	initDirs := []string{pkg.Dir}
+	if pkg.Module != nil {
+		initDirs = append(initDirs, pkg.Module.Dir)
+	}
+	for _, dir := range initDirs {
+		matches, err := filepath.Glob(filepath.Join(dir, instrument.InitPackageDir(instrument.DefaultPrefix+"*"), instrument.InitFileName))
+		if err != nil {
+			return err
+		}
+		initFiles = append(initFiles, matches...)
+	}
+	// the files making the packages the program imports import the init package
+	deps, err := listPackages("-e", "-deps", pkg.Dir)
+	if err != nil {
+		return err
+	}
+	var importFiles []string
+	for _, dep := range deps {
+		if dep.Standard || dep.Dir == "" || dep.Dir == pkg.Dir {
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(dep.Dir, instrument.InitImportFileName(instrument.DefaultPrefix+"*")))
+		if err != nil {
+			return err
+		}
+		importFiles = append(importFiles, matches...)
+	}
+	if initFiles, err = generatedFiles(initFiles); err != nil {
+		return err
+	}
+	if importFiles, err = generatedFiles(importFiles); err != nil {
+		return err
+	}
+
+	for _, path := range without(paths, generated) {
+		if !strings.HasSuffix(path, ".go") {
+			continue
+		}
+		changed, err := stripFile(path)
+		if err != nil {
+			return err
+		}
+		if changed && options.Verbose {
+			fmt.Fprintln(os.Stderr, "Stripped", path)
+		}
+	}
+	for _, path := range append(append(generated, initFiles...), importFiles...) {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if options.Verbose {
+			fmt.Fprintln(os.Stderr, "Removed", path)
+		}
+	}
+	for _, path := range initFiles {
+		os.Remove(filepath.Dir(path))
+	}
+	if err := os.Remove(filepath.Join(pkg.Dir, manifestName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// overlayFileName is the name of the file passed to 'go build -overlay'
+// in the work directory.
+const overlayFileName = "overlay.json"
 
+// outputPaths returns the profile path baked into the instrumented binary
+// named name (without the .profile extension) and the absolute path of the
+// binary, according to the -p and -o flags. With 'goprofile run', the
+// binary is written to workdir by default.
+func outputPaths(name, workdir string) (proffile, output string, err error) {
+	proffile = profFile(name)
+
+	output = options.Output
+	if output == "" {
+		output = name + ".profile"
+		if options.Run {
+			output = filepath.Join(workdir, output)
+		}
+	} else if isDirArg(output) {
+		output = filepath.Join(output, name+".profile")
+	}
+
+	if !filepath.IsAbs(output) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", "", err
+		}
+		output = filepath.Join(wd, output)
+	}
+	return proffile, output, nil
+}
+
+// profFile returns the profile path baked into the instrumented binary
+// named name (without the .profile extension), according to the -p flag.
+func profFile(name string) string {
 	if options.ProfFile == "" {
-		options.ProfFile = name + ".pprof"
+		return name + ".pprof"
+	} else if isDirArg(options.ProfFile) {
+		return filepath.Join(options.ProfFile, name+".pprof")
 	}
+	return options.ProfFile
+}
 
-	if options.Output == "" {
-		options.Output = name + ".profile"
+// goBuildArgs returns the arguments of the 'go build' command building the
+// instrumented files in workdir to output, and the directory to run it in.
+// paths, list and pkg are as passed to build. overlay determines whether the
+// build uses the overlay written to workdir, with -overlay or for the files
+// added with -init.
+func goBuildArgs(paths []string, list bool, pkg *goPackage, workdir, output, prefix string, overlay bool) (args []string, dir string) {
+	args = []string{"build"}
+	args = append(args, options.BuildFlags...)
+	args = append(args, "-o", output)
+	if overlay {
+		args = append(args, "-overlay", filepath.Join(workdir, overlayFileName))
 	}
+	if options.Overlay {
+		if list {
+			for _, path := range paths {
+				args = append(args, filepath.Join(pkg.Dir, filepath.Base(path)))
+			}
+			args = append(args, filepath.Join(pkg.Dir, instrument.SupportFileName(prefix)))
+		}
+		return args, pkg.Dir
+	}
+	if list {
+		for _, path := range paths {
+			args = append(args, filepath.Join(workdir, filepath.Base(path)))
+		}
+		args = append(args, filepath.Join(workdir, instrument.SupportFileName(prefix)))
+	}
+	return args, workdir
+}
 
-	if !filepath.IsAbs(options.Output) {
-		options.Output = filepath.Join(wd, options.Output)
+// dryRun prints what build would do with the given files of pkg, instrumented
+// to ipkg, without writing any file or building: the files that would be
+// written and the 'go build' command, and with -diff a unified diff of the
+// changes to every source file. The work directory is printed as $WORK.
+func dryRun(paths []string, list bool, pkg *goPackage, name string, ipkg *instrument.Package) error {
+	prefix := ipkg.Prefix
+	workdir := "$WORK"
+	if options.InPlace {
+		workdir = pkg.Dir
+		fmt.Printf("# record the changes in %s\n", filepath.Join(pkg.Dir, manifestName))
+	} else if pkg.Module != nil && !options.Overlay {
+		fmt.Printf("# WORK is a new directory in %s\n", pkg.Dir)
+	}
+	proffile, output, err := outputPaths(name, workdir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range ipkg.Files {
+		if !f.Changed() {
+			continue
+		}
+		to := filepath.Join(workdir, filepath.Base(f.Path))
+		if options.InPlace {
+			to = f.Path
+			fmt.Printf("# instrument %s in-place\n", f.Path)
+		} else {
+			fmt.Printf("# instrument %s to %s\n", f.Path, to)
+		}
+		if !options.Diff {
+			continue
+		}
+		original, err := ioutil.ReadFile(f.Path)
+		if err != nil {
+			return err
+		}
+		if to == f.Path {
+			to += " (instrumented)"
+		}
+		// without the //line directives of the copies (see instrumentFiles)
+		os.Stdout.Write(unifiedDiff(f.Path, to, original, f.Source))
+	}
+	for _, path := range ipkg.Generated {
+		if options.InPlace {
+			fmt.Printf("# remove %s\n", path)
+		} else if options.Overlay {
+			fmt.Printf("# hide %s\n", path)
+		}
+	}
+	overlay := options.Overlay
+	if options.Init {
+		initPath, files, err := initFiles(paths, list, pkg, workdir, newSupportConfig(ipkg, proffile))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			fmt.Printf("# add %s\n", f.path)
+		}
+		overlay = overlay || initOverlaid(initPath)
+	}
+	fmt.Printf("# add %s\n", filepath.Join(workdir, instrument.SupportFileName(prefix)))
+	if overlay {
+		fmt.Printf("# write %s\n", filepath.Join(workdir, overlayFileName))
+	}
+
+	args, dir := goBuildArgs(paths, list, pkg, workdir, output, prefix, overlay)
+	fmt.Printf("cd %s\n", dir)
+	fmt.Println("go", strings.Join(quoteArgs(args), " "))
+	return nil
+}
+
+// quoteArgs quotes the arguments that a shell would split or expand.
+func quoteArgs(args []string) []string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"|&;<>()*?[]{}~`") {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		quoted[i] = arg
+	}
+	return quoted
+}
+
+// build instruments the given files belonging to pkg and builds the
+// instrumented binary, whose name (without the .profile extension) is
+// name. With 'goprofile run', build then runs the binary. list
+// indicates whether the files were listed on the command line
+// (see fileset).
+func build(paths []string, list bool, pkg *goPackage, name string) error {
+	// Instrument before touching any file, in particular with -inplace.
+	ipkg, err := instrumentFiles(paths)
+	if err != nil {
+		return err
+	}
+	// Files generated by an earlier run with -inplace are replaced.
+	generated := ipkg.Generated
+	if len(generated) > 0 {
+		paths = without(paths, generated)
+	}
+	// the prefix of the identifiers added to the package
+	prefix := ipkg.Prefix
+
+	if options.DryRun {
+		return dryRun(paths, list, pkg, name, ipkg)
+	}
+
+	workdir, err := makeWorkdir(pkg)
+	if err != nil {
+		return err
+	}
+	if !options.InPlace && !options.PrintWork {
+		defer os.RemoveAll(workdir)
+	}
+
+	// records the changes made with -inplace for 'goprofile revert'
+	var m *manifest
+	if options.InPlace {
+		if m, err = loadManifest(pkg.Dir); err != nil {
+			return err
+		}
+	}
+
+	proffile, output, err := outputPaths(name, workdir)
+	if err != nil {
+		return err
+	}
+	if options.Run && options.Output == "" && !options.PrintWork {
+		defer os.Remove(output)
 	}
 
 	if options.Verbose {
-		fmt.Fprintln(os.Stderr, "Will compile to", options.Output)
-		fmt.Fprintln(os.Stderr, "Instrumented executable will save cpu profile as", options.ProfFile)
+		fmt.Fprintln(os.Stderr, "Will compile to", output)
+		fmt.Fprintln(os.Stderr, "Instrumented executable will save", strings.Join(options.Profiles, ", "), "profiles based on", proffile)
+		if options.Trace {
+			fmt.Fprintln(os.Stderr, "Instrumented executable will save an execution trace")
+		}
 	}
 
-	var tos = make(map[string]string)
-	for _, path := range paths {
-		tos[path] = filepath.Join(workdir, filepath.Base(path))
+	files := make(map[string]*instrument.File)
+	for _, f := range ipkg.Files {
+		files[f.Path] = f
+	}
+
+	// maps files in the source tree to the files replacing them
+	// if the -overlay flag is given, and the files added with -init
+	var overlay = make(map[string]string)
+
+	for _, path := range generated {
+		if options.InPlace {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		} else if options.Overlay {
+			// hidden from the build
+			overlay[path] = ""
+		}
 	}
 
-	var foundMain bool
-	for from, to := range tos {
-		var fm bool
+	for _, from := range paths {
+		to := filepath.Join(workdir, filepath.Base(from))
+		f := files[from]
 		if options.InPlace {
-			fm, err = processFileInPlace(from)
+			if f != nil {
+				err = processFileInPlace(f, m)
+			}
+		} else if options.Overlay {
+			if f != nil {
+				var changed bool
+				changed, err = processFileOverlay(to, f)
+				if changed {
+					overlay[filepath.Join(pkg.Dir, filepath.Base(from))] = to
+				}
+			}
 		} else {
-			fm, err = processFile(from, to)
+			err = processFile(from, to, f)
 		}
 		if err != nil {
 			return err
 		}
-		foundMain = foundMain || fm
-		if fm && options.Verbose {
+		if f != nil && f.Main && options.Verbose {
 			fmt.Printf("Found and instrumented main() function in %s.\n", from)
 		}
 	}
 
-	if !foundMain {
-		return errors.New("Couldn't find a main() function to instrument")
+	config := newSupportConfig(ipkg, proffile)
+
+	if options.Init {
+		initPath, files, err := initFiles(paths, list, pkg, workdir, config)
+		if err != nil {
+			return err
+		}
+		config.Init = initPath
+		if err := addInitFiles(files, initPath, workdir, overlay, m); err != nil {
+			return err
+		}
 	}
 
-	if err := os.Chdir(workdir); err != nil {
+	support := filepath.Join(workdir, instrument.SupportFileName(prefix))
+	if err := writeSupportFile(support, config, options.InPlace); err != nil {
 		return err
 	}
+	if options.InPlace {
+		if err := m.create(support); err != nil {
+			return err
+		}
+	}
 
-	cmd := []string{"build"}
-	cmd = append(cmd, options.BuildFlags...)
-	cmd = append(cmd, "-o", options.Output)
-	if list {
-		for _, to := range tos {
-			fmt.Println("to:", to)
-			cmd = append(cmd, to)
+	if options.Overlay {
+		// The support file is added to the package's directory.
+		overlay[filepath.Join(pkg.Dir, instrument.SupportFileName(prefix))] = support
+	}
+	if len(overlay) > 0 {
+		if err := writeOverlay(filepath.Join(workdir, overlayFileName), overlay); err != nil {
+			return err
 		}
 	}
+	cmd, builddir := goBuildArgs(paths, list, pkg, workdir, output, prefix, len(overlay) > 0)
 	gobuild := exec.Command("go", cmd...)
+	gobuild.Dir = builddir
 	gobuild.Stdout = os.Stdout
 	gobuild.Stderr = os.Stderr
 
@@ -316,5 +1139,9 @@ func run() error {
 		return err
 	}
 
+	if options.Run {
+		return runProgram(output, proffile)
+	}
+
 	return nil
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// diffContext is the number of unchanged lines shown around changes.
+const diffContext = 3
+
+// A diffLine is a line of an edit script: op is ' ' for a line that both
+// texts have in common, '-' for a line only in the old one and '+' for a
+// line only in the new one.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// splitLines splits text into lines, keeping the line endings.
+func splitLines(text []byte) []string {
+	var lines []string
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, '\n') + 1
+		if i == 0 {
+			i = len(text)
+		}
+		lines = append(lines, string(text[:i]))
+		text = text[i:]
+	}
+	return lines
+}
+
+// diffLines returns an edit script turning the lines a into the lines b.
+// Common leading and trailing lines are matched first; the lines in between
+// are matched by their longest common subsequence, unless there are too many
+// of them, in which case they are simply replaced.
+func diffLines(a, b []string) []diffLine {
+	var prefix, suffix int
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var script []diffLine
+	for _, line := range a[:prefix] {
+		script = append(script, diffLine{' ', line})
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(ma)*len(mb) > 1<<22 {
+		for _, line := range ma {
+			script = append(script, diffLine{'-', line})
+		}
+		for _, line := range mb {
+			script = append(script, diffLine{'+', line})
+		}
+	} else {
+		// lcs[i][j] is the length of the longest common subsequence
+		// of ma[i:] and mb[j:]
+		lcs := make([][]int, len(ma)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(mb)+1)
+		}
+		for i := len(ma) - 1; i >= 0; i-- {
+			for j := len(mb) - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(ma) || j < len(mb) {
+			switch {
+			case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+				script = append(script, diffLine{' ', ma[i]})
+				i++
+				j++
+			case j == len(mb) || i < len(ma) && lcs[i+1][j] >= lcs[i][j+1]:
+				script = append(script, diffLine{'-', ma[i]})
+				i++
+			default:
+				script = append(script, diffLine{'+', mb[j]})
+				j++
+			}
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		script = append(script, diffLine{' ', line})
+	}
+	return script
+}
+
+// unifiedDiff returns a unified diff turning the text a, named aName, into
+// the text b, named bName, like 'diff -u' does. It returns nil if the texts
+// are equal.
+func unifiedDiff(aName, bName string, a, b []byte) []byte {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	script := diffLines(splitLines(a), splitLines(b))
+
+	// aLines[k] and bLines[k] count the lines of a and b before script[k]
+	aLines := make([]int, len(script)+1)
+	bLines := make([]int, len(script)+1)
+	for k, line := range script {
+		aLines[k+1], bLines[k+1] = aLines[k], bLines[k]
+		if line.op != '+' {
+			aLines[k+1]++
+		}
+		if line.op != '-' {
+			bLines[k+1]++
+		}
+	}
+	// nextChange returns the index of the first change at or after k
+	nextChange := func(k int) int {
+		for k < len(script) && script[k].op == ' ' {
+			k++
+		}
+		return k
+	}
+	// hunkRange formats the start and length of a hunk like diff does
+	hunkRange := func(start, count int) string {
+		if count == 0 {
+			return fmt.Sprintf("%d,0", start)
+		}
+		if count == 1 {
+			return fmt.Sprint(start + 1)
+		}
+		return fmt.Sprintf("%d,%d", start+1, count)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", aName, bName)
+	for k := nextChange(0); k < len(script); k = nextChange(k) {
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		// extend the hunk while the next change is close enough
+		last := k
+		for next := nextChange(last + 1); next < len(script) && next-last-1 <= 2*diffContext; next = nextChange(last + 1) {
+			last = next
+		}
+		end := last + 1 + diffContext
+		if end > len(script) {
+			end = len(script)
+		}
+
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n",
+			hunkRange(aLines[start], aLines[end]-aLines[start]),
+			hunkRange(bLines[start], bLines[end]-bLines[start]))
+		for _, line := range script[start:end] {
+			buf.WriteByte(line.op)
+			buf.WriteString(line.text)
+			if len(line.text) == 0 || line.text[len(line.text)-1] != '\n' {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		k = end
+	}
+	return buf.Bytes()
+}
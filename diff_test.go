@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		a, b, expected string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{"a\nb\nc\n", "a\nx\nc\n", `--- a
++++ b
+@@ -1,3 +1,3 @@
+ a
+-b
++x
+ c
+`},
+		{"", "a\n", `--- a
++++ b
+@@ -0,0 +1 @@
++a
+`},
+		{"a\nb", "a\nb\n", `--- a
++++ b
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++b
+`},
+		// changes far apart get hunks of their own
+		{"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n", `--- a
++++ b
+@@ -1,3 +1,4 @@
++0
+ 1
+ 2
+ 3
+@@ -7,4 +8,3 @@
+ 7
+ 8
+ 9
+-10
+`},
+	} {
+		if actual := string(unifiedDiff("a", "b", []byte(test.a), []byte(test.b))); actual != test.expected {
+			t.Fatalf("diff of %q and %q:\nExpected:\n%s\nActual:\n%s", test.a, test.b, test.expected, actual)
+		}
+	}
+}
+
+func TestDiffLinesMinimal(t *testing.T) {
+	t.Parallel()
+	a := splitLines([]byte("x\na\nb\nc\ny\nd\n"))
+	b := splitLines([]byte("a\nz\nb\nc\nd\nw\n"))
+	var changes int
+	for _, line := range diffLines(a, b) {
+		if line.op != ' ' {
+			changes++
+		}
+	}
+	// the longest common subsequence is a, b, c, d
+	if changes != 4 {
+		t.Fatalf("Expected 4 changed lines, got %d\n%s", changes, strings.Join(a, ""))
+	}
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/lorenzb/goprofile/instrument"
 )
 
 // A testEnv is a test environment that can be created and disposed.
@@ -44,6 +51,8 @@ func NewTestEnv(t *testing.T, name string) *testEnv {
 	}
 	te.Run("go", "build", "-o", filepath.Join(name, "goprofile"))
 	te.wd = name
+	// The programs in test/gopath are built in GOPATH mode.
+	te.SetEnv("GO111MODULE", "off")
 	return &te
 }
 
@@ -72,14 +81,38 @@ func (te *testEnv) DuplicateFile(from, to string) {
 }
 
 func (te *testEnv) Run(name string, args ...string) (output []byte) {
+	return te.RunInDir(".", name, args...)
+}
+
+// RunInDir is like Run, but runs the command in the given directory
+// (relative to the working directory).
+func (te *testEnv) RunInDir(dir string, name string, args ...string) (output []byte) {
+	return te.run(dir, 0, name, args...)
+}
+
+// RunFailing runs a command that is expected to fail with the given exit code.
+func (te *testEnv) RunFailing(exitCode int, name string, args ...string) (output []byte) {
+	return te.run(".", exitCode, name, args...)
+}
+
+// run runs a command in the given directory (relative to the working
+// directory) and checks that it exits with the given exit code.
+func (te *testEnv) run(dir string, exitCode int, name string, args ...string) (output []byte) {
 	cmd := exec.Command(name, args...)
 	for key, val := range te.envVars {
 		cmd.Env = append(cmd.Env, key+"="+val)
 	}
-	cmd.Dir = te.wd
+	cmd.Dir = filepath.Join(te.wd, dir)
 	output, err := cmd.CombinedOutput()
-	if err != nil {
-		te.t.Fatalf("Call to '%s':%s\nEnvironment:%v\nWd:%s\nOutput:%s", name, err, cmd.Env, cmd.Dir, output)
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		code = -1
+	}
+	if code != exitCode {
+		te.t.Fatalf("Call to '%s': expected exit code %d, got %d (%v)\nEnvironment:%v\nWd:%s\nOutput:%s",
+			name, exitCode, code, err, cmd.Env, cmd.Dir, output)
 	}
 	return
 }
@@ -196,6 +229,406 @@ func TestFlagsInplace(t *testing.T) {
 	te.Dispose()
 }
 
+func TestProfiles(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-profiles")
+	te.Run("./goprofile", "-p", "out.pprof", "-profiles", "cpu,heap,allocs,block,mutex,goroutine,threadcreate",
+		pathHelloworld,
+		pathGreeting,
+	)
+	te.RunCheckOutput([]byte("Hello world!\n"), "./helloworld.profile")
+	te.CheckNotEmpty("out.pprof")
+	for _, kind := range []string{"heap", "allocs", "block", "mutex", "goroutine", "threadcreate"} {
+		te.CheckNotEmpty("out." + kind + ".pprof")
+	}
+	checkOriginalsNotTouched(te)
+	te.Dispose()
+}
+
+func TestTrace(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-trace")
+	te.Run("./goprofile", "-trace", pathHallowelt)
+	te.RunCheckOutput([]byte("Hallo Welt!\n"), "./hallowelt.profile")
+	te.CheckNotEmpty("hallowelt.pprof")
+	te.CheckNotEmpty("hallowelt.trace")
+	checkOriginalsNotTouched(te)
+	te.Dispose()
+}
+
+func TestEnvOut(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-envout")
+	te.Run("./goprofile", "-profiles", "cpu,heap,mutex", pathHelloworld, pathGreeting)
+	te.SetEnv("GOPROFILE_OUT", "{exe}-{pid}.pprof")
+	te.SetEnv("GOPROFILE_HEAP_OUT", "heap-{hostname}.pprof")
+	te.RunCheckOutput([]byte("Hello world!\n"), "./helloworld.profile")
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.CheckNotEmpty("heap-" + hostname + ".pprof")
+	matches, err := filepath.Glob(filepath.Join(te.wd, "helloworld-*.mutex.pprof"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("Expected one mutex profile, got %v (%v)", matches, err)
+	}
+	// e.g. helloworld-1234.pprof
+	cpu := strings.TrimSuffix(filepath.Base(matches[0]), ".mutex.pprof") + ".pprof"
+	te.CheckNotEmpty(cpu)
+	if _, err := os.Stat(filepath.Join(te.wd, "helloworld.pprof")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the path given at build time not to be used (%v)", err)
+	}
+	te.Dispose()
+}
+
+func TestInterval(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-interval")
+	te.Run("./goprofile", "-interval", "1s", "-keep", "2", "-profiles", "cpu,heap",
+		filepath.FromSlash("../test/gopath/src/hello/busy/busy.go"),
+	)
+	te.RunCheckOutput([]byte("Busy world! true\n"), "./busy.profile")
+	// The program runs for more than three intervals,
+	// but only the profiles of the last two are kept.
+	for _, pattern := range []string{"busy.2*.pprof", "busy.heap.2*.pprof"} {
+		matches, err := filepath.Glob(filepath.Join(te.wd, pattern))
+		if err != nil || len(matches) != 2 {
+			t.Fatalf("Expected two files matching %s, got %v (%v)", pattern, matches, err)
+		}
+		for _, match := range matches {
+			te.CheckNotEmpty(filepath.Base(match))
+		}
+	}
+	te.Dispose()
+}
+
+func TestHTTP(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-http")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	te.Run("./goprofile", "-profiles", "none", "-http", addr, "-cpurate", "500",
+		filepath.FromSlash("../test/gopath/src/hello/sleep/sleep.go"),
+	)
+
+	program := exec.Command(te.Abs("sleep.profile"))
+	if err := program.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer program.Process.Kill()
+
+	var body []byte
+	for i := 0; i < 50; i++ {
+		resp, err := http.Get("http://" + addr + "/debug/pprof/goroutine?debug=1")
+		if err == nil {
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !strings.Contains(string(body), "main.main") {
+		t.Fatalf("Expected goroutine profile served at %s to contain main.main\n%s", addr, body)
+	}
+	if _, err := os.Stat(te.Abs("sleep.pprof")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no profile to be written with -profiles none (%v)", err)
+	}
+
+	// The cpu profile is sampled at the rate given with -cpurate.
+	resp, err := http.Get("http://" + addr + "/debug/pprof/profile?seconds=0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof, err := profile.Parse(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prof.Period != 1e9/500 {
+		t.Fatalf("Expected a sampling period of %d, got %d", int64(1e9/500), prof.Period)
+	}
+	program.Process.Kill()
+	program.Wait()
+
+	// The program runs even if the address is in use.
+	te.Run("./goprofile", "-http", addr, pathHelloworld, pathGreeting)
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if out := te.Run("./helloworld.profile"); !strings.Contains(string(out), "Hello world!\n") {
+		t.Fatalf("Expected the program to run\n%s", out)
+	}
+	te.CheckNotEmpty("helloworld.pprof")
+	te.Dispose()
+}
+
+func TestDelayDuration(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-window")
+	te.Run("./goprofile", "-delay", "1s", "-duration", "1s", "-profiles", "cpu,heap",
+		filepath.FromSlash("../test/gopath/src/hello/sleep/sleep.go"),
+	)
+
+	program := exec.Command(te.Abs("sleep.profile"))
+	program.Dir = te.wd
+	stdout, err := program.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := program.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer program.Process.Kill()
+	// wait until main() runs
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "Sleeping world!\n" {
+		t.Fatalf("Unexpected output %#v (%v)", line, err)
+	}
+	if _, err := os.Stat(te.Abs("sleep.pprof")); !os.IsNotExist(err) {
+		t.Fatalf("Expected profiling not to start before the delay (%v)", err)
+	}
+
+	// The profiles are written while the program keeps running.
+	time.Sleep(3 * time.Second)
+	te.CheckNotEmpty("sleep.pprof")
+	te.CheckNotEmpty("sleep.heap.pprof")
+	program.Process.Kill()
+	program.Wait()
+	te.Dispose()
+}
+
+func TestCPURate(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-cpurate")
+	te.Run("./goprofile", "-cpurate", "500", pathHelloworld, pathGreeting)
+	te.Run("./helloworld.profile")
+
+	f, err := os.Open(te.Abs("helloworld.pprof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := profile.Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sampling period in nanoseconds
+	if prof.Period != 1e9/500 {
+		t.Fatalf("Expected a sampling period of %d, got %d", int64(1e9/500), prof.Period)
+	}
+	te.Dispose()
+}
+
+// sampled determines whether a function with the given name appears in the
+// samples of the profile at path.
+func (te *testEnv) sampled(path, name string) bool {
+	f, err := os.Open(te.Abs(path))
+	if err != nil {
+		te.t.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := profile.Parse(f)
+	if err != nil {
+		te.t.Fatal(err)
+	}
+	for _, sample := range prof.Sample {
+		for _, loc := range sample.Location {
+			for _, line := range loc.Line {
+				if line.Function != nil && line.Function.Name == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func TestInit(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-init")
+	te.SetEnv("GOPATH", te.Abs("../test/gopath"))
+	// main.spin only runs while the package is initialized.
+	te.Run("./goprofile", "hello/slowinit")
+	te.RunCheckOutput([]byte("Initialized world! true\n"), "./slowinit.profile")
+	if te.sampled("slowinit.pprof", "main.spin") {
+		t.Fatal("Expected main.spin not to be profiled without -init")
+	}
+	for _, args := range [][]string{
+		{"-init", "-trace", "hello/slowinit"},
+		{"-init", "-overlay", "hello/slowinit"},
+		{"-init", filepath.FromSlash("../test/gopath/src/hello/slowinit/slowinit.go")},
+	} {
+		te.Run("./goprofile", args...)
+		te.RunCheckOutput([]byte("Initialized world! true\n"), "./slowinit.profile")
+		if !te.sampled("slowinit.pprof", "main.spin") {
+			t.Fatalf("Expected main.spin to be profiled with %v", args)
+		}
+	}
+	te.CheckNotEmpty("slowinit.trace")
+
+	te.SetEnv("GO111MODULE", "on")
+	modDir := filepath.FromSlash("../test/mod/hello")
+	for _, args := range [][]string{{"-init"}, {"-init", "-overlay"}} {
+		args = append(args, "-o", te.Abs("hello.profile"), "-p", te.Abs("hello.pprof"), "./cmd/hello")
+		te.RunInDir(modDir, te.Abs("goprofile"), args...)
+		te.RunCheckOutput([]byte("Greetings, module world!\n"), "./hello.profile")
+		te.CheckNotEmpty("hello.pprof")
+	}
+	leftovers, err := filepath.Glob(filepath.Join(te.wd, modDir, instrument.InitPackageDir(instrument.DefaultPrefix)+"*"))
+	if err != nil || len(leftovers) != 0 {
+		t.Fatalf("Init package not cleaned up: %v (%v)", leftovers, err)
+	}
+	te.Dispose()
+}
+
+func TestInitInplaceGOPATH(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-init-inplace")
+	// The files given on the command line are part of the GOPATH, so the
+	// init package can't be imported by a relative path.
+	dir := filepath.Join("gopath", "src", "hello", "slowinit")
+	if err := os.MkdirAll(te.Abs(dir), 0777); err != nil {
+		t.Fatal(err)
+	}
+	te.SetEnv("GOPATH", te.Abs("gopath"))
+	original := filepath.FromSlash("../test/gopath/src/hello/slowinit/slowinit.go")
+	te.CopyFile(original, filepath.Join(dir, "slowinit.go"))
+	te.Run("./goprofile", "-init", "-inplace", filepath.Join(dir, "slowinit.go"))
+	te.RunCheckOutput([]byte("Initialized world! true\n"), "./slowinit.profile")
+	if !te.sampled("slowinit.pprof", "main.spin") {
+		t.Fatal("Expected main.spin to be profiled with -init")
+	}
+	te.Run("./goprofile", "revert", dir)
+	te.CheckSame(original, filepath.Join(dir, "slowinit.go"))
+	te.Dispose()
+}
+
+func TestInitImports(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-init-imports")
+	te.SetEnv("GO111MODULE", "on")
+	// seed.spin only runs while example.com/slowimport/seed is initialized,
+	// which doesn't import the packages the init package imports.
+	modDir := filepath.FromSlash("../test/mod/slowimport")
+	for _, args := range [][]string{{"-init"}, {"-init", "-overlay"}} {
+		args = append(args, "-o", te.Abs("slowimport.profile"), "-p", te.Abs("slowimport.pprof"), ".")
+		te.RunInDir(modDir, te.Abs("goprofile"), args...)
+		te.RunCheckOutput([]byte("Initialized world! true\n"), "./slowimport.profile")
+		if !te.sampled("slowimport.pprof", "example.com/slowimport/seed.spin") {
+			t.Fatalf("Expected seed.spin to be profiled with %v", args)
+		}
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(te.wd, modDir, "seed", instrument.DefaultPrefix+"*")); len(leftovers) != 0 {
+		t.Fatalf("Expected the imported package not to be changed, found %v", leftovers)
+	}
+
+	// in-place in GOPATH mode
+	te.SetEnv("GO111MODULE", "off")
+	te.SetEnv("GOPATH", te.Abs("gopath"))
+	dir := filepath.Join("gopath", "src", "example.com", "slowimport")
+	if err := os.MkdirAll(te.Abs(filepath.Join(dir, "seed")), 0777); err != nil {
+		t.Fatal(err)
+	}
+	te.CopyFile(filepath.Join(modDir, "main.go"), filepath.Join(dir, "main.go"))
+	te.CopyFile(filepath.Join(modDir, "seed", "seed.go"), filepath.Join(dir, "seed", "seed.go"))
+	for _, undo := range [][]string{{"revert"}, {"-strip", "."}} {
+		te.RunInDir(dir, te.Abs("goprofile"), "-init", "-inplace", "-o", te.Abs("slowimport.profile"), "-p", te.Abs("slowimport.pprof"), ".")
+		te.RunCheckOutput([]byte("Initialized world! true\n"), "./slowimport.profile")
+		if !te.sampled("slowimport.pprof", "example.com/slowimport/seed.spin") {
+			t.Fatal("Expected seed.spin to be profiled with -inplace")
+		}
+		te.RunInDir(dir, te.Abs("goprofile"), undo...)
+		files, err := filepath.Glob(te.Abs(filepath.Join(dir, "seed", "*")))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("Expected goprofile %s to leave only seed.go, found %v (%v)", undo[0], files, err)
+		}
+	}
+	te.Dispose()
+}
+
+func TestLineDirectives(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-line")
+	te.Run("./goprofile", "-profiles", "goroutine",
+		pathHelloworld,
+		pathGreeting,
+	)
+	te.RunCheckOutput([]byte("Hello world!\n"), "./helloworld.profile")
+	// At the time the goroutine profile is written, main.main
+	// returns at the closing brace of main() in helloworld.go.
+	out := te.Run("go", "tool", "pprof", "-raw", "helloworld.profile", "helloworld.goroutine.pprof")
+	if !strings.Contains(string(out), te.Abs(pathHelloworld)+":10") {
+		t.Fatalf("Expected profile to refer to %s:10\n%s", te.Abs(pathHelloworld), out)
+	}
+	checkOriginalsNotTouched(te)
+	te.Dispose()
+}
+
+func TestLabel(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-label")
+	te.Run("./goprofile", "-profiles", "goroutine", "-label", `\(\*server\)\.handle`,
+		filepath.FromSlash("../test/gopath/src/hello/labels/labels.go"),
+	)
+	te.RunCheckOutput([]byte("Labeled world!\n"), "./labels.profile")
+	out := te.Run("go", "tool", "pprof", "-tags", "labels.profile", "labels.goroutine.pprof")
+	if !strings.Contains(string(out), "main.(*server).handle") {
+		t.Fatalf("Expected profile to have the label func=main.(*server).handle\n%s", out)
+	}
+	te.Dispose()
+}
+
+// sampleLabels returns the labels of the first sample of the profile at path
+// whose stack contains the function with the given name.
+func (te *testEnv) sampleLabels(path, name string) map[string][]string {
+	f, err := os.Open(te.Abs(path))
+	if err != nil {
+		te.t.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := profile.Parse(f)
+	if err != nil {
+		te.t.Fatal(err)
+	}
+	for _, sample := range prof.Sample {
+		for _, loc := range sample.Location {
+			for _, line := range loc.Line {
+				if line.Function != nil && line.Function.Name == name {
+					return sample.Label
+				}
+			}
+		}
+	}
+	te.t.Fatalf("No sample of %s contains %s", path, name)
+	return nil
+}
+
+func TestLabelNested(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-label-nested")
+	te.Run("./goprofile", "-profiles", "goroutine", "-label", `main\.(outer|inner)$`,
+		filepath.FromSlash("../test/gopath/src/hello/nestedlabels/nestedlabels.go"),
+	)
+	te.RunCheckOutput([]byte("Nested world!\n"), "./nestedlabels.profile")
+	// Both goroutines block after main.inner returned.
+	if labels := te.sampleLabels("nestedlabels.goroutine.pprof", "main.outer"); !reflect.DeepEqual(labels, map[string][]string{"func": {"main.outer"}}) {
+		t.Fatalf("Expected main.outer to keep its label, got %v", labels)
+	}
+	if labels := te.sampleLabels("nestedlabels.goroutine.pprof", "main.request"); !reflect.DeepEqual(labels, map[string][]string{"request": {"1"}}) {
+		t.Fatalf("Expected main.request to keep the labels set by pprof.Do, got %v", labels)
+	}
+	te.Dispose()
+}
+
 func TestBuildFlags(t *testing.T) {
 	t.Parallel()
 	te := NewTestEnv(t, "temp_test-hello-german")
@@ -243,6 +676,267 @@ func TestPackage(t *testing.T) {
 	te.Dispose()
 }
 
+func TestBuildConstraints(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-constraints")
+	te.SetEnv("GOPATH", te.Abs("../test/gopath"))
+	out := te.Run("./goprofile", "-v", "-buildflags", "-tags german", "hello/world")
+	if !strings.Contains(string(out), "hallowelt.go") || strings.Contains(string(out), "helloworld.go") {
+		t.Fatalf("Expected only hallowelt.go to be instrumented\n%s", out)
+	}
+	te.RunCheckOutput([]byte("Hallo Welt!\n"), "./world.profile")
+	checkOriginalsNotTouched(te)
+	te.Dispose()
+}
+
+func TestMultipleMains(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-mains")
+	// Build constraints don't apply to files listed on the command line.
+	out := te.RunFailing(1, "./goprofile", pathHelloworld, pathHallowelt, pathGreeting)
+	if !strings.Contains(string(out), "more than one main() function") {
+		t.Fatalf("Expected error about multiple main functions\n%s", out)
+	}
+	checkOriginalsNotTouched(te)
+	te.Dispose()
+}
+
+func TestExit(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-exit")
+	te.SetEnv("GOPATH", te.Abs("../test/gopath"))
+	te.Run("./goprofile", "-profiles", "cpu,heap", "hello/exit")
+	if out := te.RunFailing(3, "./exit.profile"); string(out) != "Goodbye world!\n" {
+		t.Fatalf("Unexpected output %#v", string(out))
+	}
+	te.CheckNotEmpty("exit.pprof")
+	te.CheckNotEmpty("exit.heap.pprof")
+	te.Dispose()
+}
+
+func TestFatal(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-fatal")
+	te.SetEnv("GOPATH", te.Abs("../test/gopath"))
+	te.Run("./goprofile", "-profiles", "cpu,heap", "hello/exit")
+	if out := te.RunFailing(1, "./exit.profile", "Fatal world!"); string(out) != "Fatal world!\n" {
+		t.Fatalf("Unexpected output %#v", string(out))
+	}
+	te.CheckNotEmpty("exit.pprof")
+	te.CheckNotEmpty("exit.heap.pprof")
+	te.Dispose()
+}
+
+func TestPanic(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-panic")
+	te.SetEnv("GOPATH", te.Abs("../test/gopath"))
+	te.Run("./goprofile", "-profiles", "cpu,heap", "hello/panic")
+	if out := te.RunFailing(2, "./panic.profile"); !strings.Contains(string(out), "Panicking world!") {
+		t.Fatalf("Unexpected output %#v", string(out))
+	}
+	te.CheckNotEmpty("panic.pprof")
+	te.CheckNotEmpty("panic.heap.pprof")
+	te.Dispose()
+}
+
+func TestHygiene(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-hygiene")
+	te.Run("./goprofile", "-trace", "-profiles", "cpu,heap",
+		filepath.FromSlash("../test/gopath/src/hello/hygiene/hygiene.go"),
+	)
+	te.RunCheckOutput([]byte("Hygienic world!\n"), "./hygiene.profile")
+	te.CheckNotEmpty("hygiene.pprof")
+	te.CheckNotEmpty("hygiene.heap.pprof")
+	te.CheckNotEmpty("hygiene.trace")
+	te.Dispose()
+}
+
+func TestModule(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-module")
+	te.SetEnv("GO111MODULE", "on")
+	modDir := filepath.FromSlash("../test/mod/hello")
+	for _, args := range [][]string{
+		{"./cmd/hello"},
+		{"example.com/hello/cmd/hello"},
+	} {
+		args = append([]string{"-o", te.Abs("hello.profile"), "-p", te.Abs("hello.pprof")}, args...)
+		te.RunInDir(modDir, te.Abs("goprofile"), args...)
+		te.RunCheckOutput([]byte("Greetings, module world!\n"), "./hello.profile")
+		te.CheckNotEmpty("hello.pprof")
+	}
+
+	// package in the current directory, named after its import path
+	te.RunInDir(filepath.Join(modDir, "cmd", "hello"), te.Abs("goprofile"),
+		"-p", te.Abs("hello.pprof"), "-o", te.Abs("current.profile"))
+	te.RunCheckOutput([]byte("Greetings, module world!\n"), "./current.profile")
+
+	leftovers, err := filepath.Glob(filepath.Join(te.wd, modDir, "cmd", "hello", "_goprofile*"))
+	if err != nil || len(leftovers) != 0 {
+		t.Fatalf("Work directories not cleaned up: %v (%v)", leftovers, err)
+	}
+	te.Dispose()
+}
+
+func TestToolexec(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-toolexec")
+	te.SetEnv("GO111MODULE", "on")
+	modDir := filepath.FromSlash("../test/mod/hello")
+	toolexec := te.Abs("goprofile") + " -p " + te.Abs("hello.pprof")
+	te.RunInDir(modDir, "go", "build", "-toolexec", toolexec, "-o", te.Abs("hello.profile"), "./cmd/hello")
+	te.RunCheckOutput([]byte("Greetings, module world!\n"), "./hello.profile")
+	te.CheckNotEmpty("hello.pprof")
+
+	if runtime.GOOS == "linux" {
+		// net, which the program doesn't import, is built with the tags given to the go command.
+		toolexec := te.Abs("goprofile") + " -http localhost:0 -p " + te.Abs("netgo.pprof")
+		te.RunInDir(modDir, "go", "build", "-tags", "netgo", "-toolexec", toolexec, "-o", te.Abs("netgo.profile"), "./cmd/hello")
+		te.RunCheckOutput([]byte("Greetings, module world!\n"), "./netgo.profile")
+		te.CheckNotEmpty("netgo.pprof")
+	}
+
+	// The build cache doesn't mix up instrumented and vanilla packages.
+	if err := os.Remove(te.Abs("hello.pprof")); err != nil {
+		t.Fatal(err)
+	}
+	te.RunInDir(modDir, "go", "build", "-o", te.Abs("hello"), "./cmd/hello")
+	te.RunCheckOutput([]byte("Greetings, module world!\n"), "./hello")
+	if _, err := os.Stat(te.Abs("hello.pprof")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the vanilla binary not to write a profile (%v)", err)
+	}
+
+	// GOPATH mode, with the profile named after the package
+	te.SetEnv("GO111MODULE", "off")
+	te.SetEnv("GOPATH", te.Abs("../test/gopath"))
+	te.Run("go", "build", "-toolexec", te.Abs("goprofile"), "-o", "world.profile", "hello/world")
+	te.RunCheckOutput([]byte("Hello world!\n"), "./world.profile")
+	te.CheckNotEmpty("world.pprof")
+
+	leftovers, err := filepath.Glob(filepath.Join(te.wd, modDir, "cmd", "hello", "*goprofile*"))
+	if err != nil || len(leftovers) != 0 {
+		t.Fatalf("Files left in the package: %v (%v)", leftovers, err)
+	}
+	checkOriginalsNotTouched(te)
+	te.Dispose()
+}
+
+func TestOverlay(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-overlay")
+	te.SetEnv("GO111MODULE", "on")
+	modDir := filepath.FromSlash("../test/mod/hello")
+	te.RunInDir(modDir, te.Abs("goprofile"), "-overlay",
+		"-o", te.Abs("embed.profile"), "-p", te.Abs("embed.pprof"), "./cmd/embed")
+	te.RunCheckOutput([]byte("Embedded world!\n"), "./embed.profile")
+	te.CheckNotEmpty("embed.pprof")
+	te.CheckNotTouched(filepath.Join(modDir, "cmd", "embed", "main.go"))
+	if _, err := os.Stat(filepath.Join(te.wd, modDir, "cmd", "embed", instrument.SupportFileName(instrument.DefaultPrefix))); !os.IsNotExist(err) {
+		t.Fatalf("Support file written to source tree (%v)", err)
+	}
+
+	te.SetEnv("GO111MODULE", "off")
+	te.Run("./goprofile", "-overlay", pathHelloworld, pathGreeting)
+	te.RunCheckOutput([]byte("Hello world!\n"), "./helloworld.profile")
+	te.CheckNotEmpty("helloworld.pprof")
+
+	te.SetEnv("GOPATH", te.Abs("../test/gopath"))
+	te.Run("./goprofile", "-overlay", "-buildflags", "-tags german", "hello/world")
+	te.RunCheckOutput([]byte("Hallo Welt!\n"), "./world.profile")
+	te.CheckNotEmpty("world.pprof")
+	checkOriginalsNotTouched(te)
+	te.Dispose()
+}
+
+func TestPatterns(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-module-patterns")
+	te.SetEnv("GO111MODULE", "on")
+	if err := os.Mkdir(te.Abs("profiles"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	modDir := filepath.FromSlash("../test/mod/hello")
+	// cmd/embed embeds a file and is built with -overlay therefore.
+	te.RunInDir(modDir, te.Abs("goprofile"), "-overlay",
+		"-o", te.Abs("bin")+string(filepath.Separator),
+		"-p", te.Abs("profiles")+string(filepath.Separator),
+		"./cmd/...")
+	te.RunCheckOutput([]byte("Greetings, module world!\n"), filepath.Join("bin", "hello.profile"))
+	te.RunCheckOutput([]byte("Embedded world!\n"), filepath.Join("bin", "embed.profile"))
+	te.CheckNotEmpty(filepath.Join("profiles", "hello.pprof"))
+	te.CheckNotEmpty(filepath.Join("profiles", "embed.pprof"))
+	te.Dispose()
+}
+
+func TestPatternsOutputFile(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-patterns")
+	te.SetEnv("GOPATH", te.Abs("../test/gopath"))
+	out := te.RunFailing(1, "./goprofile", "-o", "single.profile", "hello/...")
+	if !strings.Contains(string(out), "-o must be a directory") {
+		t.Fatalf("Expected error about -o\n%s", out)
+	}
+	te.Dispose()
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-run")
+	te.SetEnv("GOPATH", te.Abs("../test/gopath"))
+	out := string(te.Run("./goprofile", "run", "-top", "5", "hello/world"))
+	if !strings.HasPrefix(out, "Hello world!\n") || !strings.Contains(out, "Profile world.pprof:") ||
+		!strings.Contains(out, "Showing top") {
+		t.Fatalf("Unexpected output %#v", out)
+	}
+	te.CheckNotEmpty("world.pprof")
+
+	out = string(te.RunFailing(3, "./goprofile", "run", "-top", "0", "-profiles", "heap", "hello/exit"))
+	if out != "Goodbye world!\n" {
+		t.Fatalf("Unexpected output %#v", out)
+	}
+	te.CheckNotEmpty("exit.heap.pprof")
+
+	out = string(te.RunFailing(1, "./goprofile", "run", "-top", "0", "hello/exit", "--", "Fatal world!"))
+	if out != "Fatal world!\n" {
+		t.Fatalf("Unexpected output %#v", out)
+	}
+
+	if runtime.GOOS != "windows" {
+		// killed by SIGKILL
+		te.RunFailing(128+9, "./goprofile", "run", "-top", "0", "hello/exit", "--", "-kill")
+	}
+
+	for _, binary := range []string{"world.profile", "exit.profile"} {
+		if _, err := os.Stat(filepath.Join(te.wd, binary)); !os.IsNotExist(err) {
+			t.Fatalf("Binary %s not removed (%v)", binary, err)
+		}
+	}
+	checkOriginalsNotTouched(te)
+	te.Dispose()
+}
+
+func TestReportCommand(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-report")
+	te.Run("./goprofile", "-profiles", "heap,goroutine", pathHallowelt)
+	te.Run("./hallowelt.profile")
+	out := string(te.Run("./goprofile", "report", "-hidegoprofile=false", "hallowelt.goroutine.pprof", "hallowelt.profile"))
+	if !strings.Contains(out, "Type: goroutine") || !strings.Contains(out, "main.goprofileFlush") {
+		t.Fatalf("Unexpected output %s", out)
+	}
+	out = string(te.Run("./goprofile", "report", "hallowelt.goroutine.pprof"))
+	if !strings.Contains(out, "main.main") || strings.Contains(out, "main.goprofile") {
+		t.Fatalf("Unexpected output %s", out)
+	}
+	out = string(te.Run("./goprofile", "report", "-sample", "alloc_space", "hallowelt.heap.pprof"))
+	if !strings.Contains(out, "Type: alloc_space") {
+		t.Fatalf("Unexpected output %s", out)
+	}
+	te.Dispose()
+}
+
 func TestEmpty(t *testing.T) {
 	t.Parallel()
 	te := NewTestEnv(t, "temp_test-hello-empty")
@@ -265,19 +959,164 @@ func TestEmptyInplace(t *testing.T) {
 	te.Run("./goprofile", "-inplace")
 	te.RunCheckOutput([]byte("Hello world!\n"), "./temp_test-hello-empty-inplace.profile")
 	te.CheckNotEmpty("temp_test-hello-empty-inplace.profile")
-	te.CheckDifferent(pathHallowelt, "hallowelt.go")
+	// hallowelt.go is excluded from the build by its build constraint
+	te.CheckSame(pathHallowelt, "hallowelt.go")
 	te.CheckDifferent(pathHelloworld, "helloworld.go")
 	te.CheckSame(pathGreeting, "greeting.go")
 	te.Dispose()
 }
 
+func TestRevert(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-revert")
+	te.CopyFile(pathHelloworld, "helloworld.go")
+	te.CopyFile(pathGreeting, "greeting.go")
+	te.Run("./goprofile", "-inplace", "-init", "helloworld.go", "greeting.go")
+	te.RunCheckOutput([]byte("Hello world!\n"), "./helloworld.profile")
+	te.CheckNotEmpty(manifestName)
+	te.CheckDifferent(pathHelloworld, "helloworld.go")
+
+	// edited after instrumentation
+	instrumented, err := ioutil.ReadFile(te.Abs("helloworld.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := append(append([]byte(nil), instrumented...), "// edited\n"...)
+	if err := ioutil.WriteFile(te.Abs("helloworld.go"), edited, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := te.RunFailing(1, "./goprofile", "revert")
+	if !strings.Contains(string(out), "-// edited") || !strings.Contains(string(out), "changed after instrumentation") {
+		t.Fatalf("Expected revert to refuse with a diff\n%s", out)
+	}
+	te.CheckNotEmpty(instrument.SupportFileName(instrument.DefaultPrefix))
+
+	if err := ioutil.WriteFile(te.Abs("helloworld.go"), instrumented, 0644); err != nil {
+		t.Fatal(err)
+	}
+	te.Run("./goprofile", "revert")
+	te.CheckSame(pathHelloworld, "helloworld.go")
+	te.CheckSame(pathGreeting, "greeting.go")
+	for _, name := range []string{manifestName, instrument.SupportFileName(instrument.DefaultPrefix), instrument.InitPackageDir(instrument.DefaultPrefix)} {
+		if _, err := os.Stat(te.Abs(name)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be removed (%v)", name, err)
+		}
+	}
+	te.RunFailing(1, "./goprofile", "revert")
+	te.Dispose()
+}
+
+func TestRevertEdited(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-revert-edited")
+	te.CopyFile(pathHelloworld, "helloworld.go")
+	te.CopyFile(pathGreeting, "greeting.go")
+	te.Run("./goprofile", "-inplace", "helloworld.go", "greeting.go")
+
+	// edited between two instrumentations
+	instrumented, err := ioutil.ReadFile(te.Abs("helloworld.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := strings.Replace(string(instrumented), `"world"`, `"edited world"`, 1)
+	if err := ioutil.WriteFile(te.Abs("helloworld.go"), []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	te.Run("./goprofile", "-inplace", "helloworld.go", "greeting.go")
+	te.RunCheckOutput([]byte("Hello edited world!\n"), "./helloworld.profile")
+
+	te.Run("./goprofile", "revert")
+	reverted, err := ioutil.ReadFile(te.Abs("helloworld.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := ioutil.ReadFile(te.Abs(pathHelloworld))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.Replace(string(original), `"world"`, `"edited world"`, 1); string(reverted) != expected {
+		t.Fatalf("Expected the edit to be kept by revert\n%s", reverted)
+	}
+	te.Dispose()
+}
+
+func TestStripInplace(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-strip")
+	te.CopyFile(pathHelloworld, "helloworld.go")
+	te.CopyFile(pathGreeting, "greeting.go")
+	// instrumenting again replaces the earlier instrumentation
+	te.Run("./goprofile", "-inplace", "helloworld.go", "greeting.go")
+	te.Run("./goprofile", "-inplace", "-init", "helloworld.go", "greeting.go")
+	te.RunCheckOutput([]byte("Hello world!\n"), "./helloworld.profile")
+	instrumented, err := ioutil.ReadFile(te.Abs("helloworld.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(instrumented), "Start()"); n != 1 {
+		t.Fatalf("Expected main() to be instrumented once, got %d times\n%s", n, instrumented)
+	}
+
+	te.Run("./goprofile", "-strip", "helloworld.go", "greeting.go")
+	te.CheckSame(pathHelloworld, "helloworld.go")
+	te.CheckSame(pathGreeting, "greeting.go")
+	for _, name := range []string{manifestName, instrument.SupportFileName(instrument.DefaultPrefix), instrument.InitPackageDir(instrument.DefaultPrefix)} {
+		if _, err := os.Stat(te.Abs(name)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be removed (%v)", name, err)
+		}
+	}
+	te.Dispose()
+}
+
+func TestDryRun(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-dryrun")
+	te.CopyFile(pathHelloworld, "helloworld.go")
+	te.CopyFile(pathGreeting, "greeting.go")
+	out := string(te.Run("./goprofile", "-diff", "-inplace", "helloworld.go", "greeting.go"))
+	for _, expected := range []string{
+		"--- helloworld.go\n+++ helloworld.go (instrumented)\n",
+		"+\tif !goprofileStart() {\n",
+		"# add " + te.Abs(instrument.SupportFileName(instrument.DefaultPrefix)) + "\n",
+		"go build -o " + te.Abs("helloworld.profile") + " " + te.Abs("helloworld.go"),
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("Expected output to contain %q\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "greeting.go (instrumented)") {
+		t.Fatalf("Expected no diff for greeting.go\n%s", out)
+	}
+	te.CheckSame(pathHelloworld, "helloworld.go")
+	te.CheckSame(pathGreeting, "greeting.go")
+	for _, name := range []string{manifestName, instrument.SupportFileName(instrument.DefaultPrefix), "helloworld.profile"} {
+		if _, err := os.Stat(te.Abs(name)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s not to be written (%v)", name, err)
+		}
+	}
+
+	out = string(te.Run("./goprofile", "-n", "-overlay", "-buildflags", "-tags 'a b'", "helloworld.go", "greeting.go"))
+	if !strings.Contains(out, "go build -tags 'a b' -o ") || !strings.Contains(out, " -overlay "+filepath.Join("$WORK", overlayFileName)+" ") ||
+		strings.Contains(out, "---") {
+		t.Fatalf("Unexpected output\n%s", out)
+	}
+	te.Dispose()
+}
+
 func TestSelf(t *testing.T) {
 	t.Parallel()
 	te := NewTestEnv(t, "temp_test-self")
-	te.DuplicateFile(filepath.FromSlash("../ast.go"), "ast.go")
-	te.DuplicateFile(filepath.FromSlash("../cmd.go"), "cmd.go")
-	te.DuplicateFile(filepath.FromSlash("../process.go"), "process.go")
-	te.DuplicateFile(filepath.FromSlash("../util.go"), "util.go")
+	// The copies are built as a package of goprofile's module.
+	te.SetEnv("GO111MODULE", "on")
+	sources, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range sources {
+		if !strings.HasSuffix(source, "_test.go") {
+			te.DuplicateFile(filepath.Join("..", source), source)
+		}
+	}
 	te.Run("./goprofile")
 	te.Run("./temp_test-self.profile", "-o", "temp_test-self.profile.profile", "-p", "temp_test-self.profile.pprof")
 	te.CheckNotEmpty("temp_test-self.pprof")
@@ -0,0 +1,8 @@
+module github.com/lorenzb/goprofile
+
+go 1.18
+
+require (
+	github.com/google/pprof v0.0.0-20221118152302-e6195bd50e26
+	github.com/mattn/go-shellwords v1.0.12
+)
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	gobuild "go/build" // build is taken by build() in cmd.go
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A goPackage holds the subset of the output of 'go list -json'
+// that goprofile is interested in.
+type goPackage struct {
+	Dir        string
+	ImportPath string
+	Name       string
+	// GoFiles and CgoFiles are the go source files of the package
+	// (relative to Dir) after evaluating build constraints.
+	GoFiles  []string
+	CgoFiles []string
+	// Export is the file containing the export data of the package
+	// (only set by 'go list -export').
+	Export string
+	// Standard is set for the packages of the standard library.
+	Standard bool
+	// Module is nil if the package isn't part of a module
+	// (e.g. because the go command runs in GOPATH mode).
+	Module *struct {
+		Path  string
+		Dir   string
+		GoMod string
+		// Main is set for the main module and the modules of a workspace.
+		Main bool
+		// Replace is the module replacing this one, whose version is
+		// empty if it is replaced by a directory.
+		Replace *struct {
+			Version string
+		}
+	}
+}
+
+// listPackage runs 'go list -json' on the given arguments, which must
+// either name a single package (e.g. ".", "./cmd/server" or
+// "example.com/app") or a list of go source files. The build flags
+// passed to goprofile are passed on to 'go list', so that e.g. -tags
+// and -mod are taken into account.
+func listPackage(args ...string) (*goPackage, error) {
+	pkgs, err := listPackages(args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) > 1 {
+		return nil, fmt.Errorf("%s matches more than one package", strings.Join(args, " "))
+	}
+	return pkgs[0], nil
+}
+
+// listPackages is like listPackage, but the arguments may also be
+// package patterns like "./cmd/..." matching any number of packages.
+func listPackages(args ...string) ([]*goPackage, error) {
+	cmd := []string{"list", "-json"}
+	cmd = append(cmd, options.BuildFlags...)
+	cmd = append(cmd, args...)
+
+	var stdout, stderr bytes.Buffer
+	golist := exec.Command("go", cmd...)
+	golist.Stdout = &stdout
+	golist.Stderr = &stderr
+	if err := golist.Run(); err != nil {
+		return nil, fmt.Errorf("go list failed: %s\n%s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var pkgs []*goPackage
+	dec := json.NewDecoder(&stdout)
+	for dec.More() {
+		var pkg goPackage
+		if err := dec.Decode(&pkg); err != nil {
+			return nil, fmt.Errorf("Failed to parse output of go list: %s", err)
+		}
+		pkgs = append(pkgs, &pkg)
+	}
+	if len(pkgs) == 0 {
+		return nil, fmt.Errorf("%s matches no packages", strings.Join(args, " "))
+	}
+	return pkgs, nil
+}
+
+var majorVersionSuffix = regexp.MustCompile(`^v[0-9]+$`)
+
+// binaryName returns the name 'go build' gives to the executable
+// built from the package, i.e. the last element of its import path,
+// ignoring a major version suffix like "/v2".
+func (pkg *goPackage) binaryName() string {
+	elem := path.Base(pkg.ImportPath)
+	if pkg.Module != nil && elem != pkg.ImportPath && majorVersionSuffix.MatchString(elem) {
+		elem = path.Base(path.Dir(pkg.ImportPath))
+	}
+	return elem
+}
+
+// includes determines whether the go source file with the given name
+// (relative to pkg.Dir) takes part in the build of the package. Files
+// excluded by build constraints (including _GOOS and _GOARCH suffixes)
+// and test files don't.
+func (pkg *goPackage) includes(name string) bool {
+	for _, files := range [][]string{pkg.GoFiles, pkg.CgoFiles} {
+		for _, file := range files {
+			if file == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// buildContext returns the build context corresponding to the build flags
+// passed to goprofile, i.e. go/build's default context, which is configured
+// by the environment (e.g. GOOS and CGO_ENABLED), with the tags given with
+// -tags.
+func buildContext() *gobuild.Context {
+	ctxt := gobuild.Default
+	if tags := flagValue(options.BuildFlags, "-tags"); tags != "" {
+		ctxt.BuildTags = strings.FieldsFunc(tags, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	return &ctxt
+}
+
+// gopathImportPath returns the import path of the package in the directory
+// dir if dir is part of a GOPATH, and "" otherwise.
+func gopathImportPath(dir string) string {
+	bp, err := buildContext().ImportDir(dir, gobuild.FindOnly)
+	if err != nil || bp.ImportPath == "." {
+		return ""
+	}
+	return bp.ImportPath
+}
@@ -0,0 +1,497 @@
+package instrument
+
+import (
+	"go/ast"
+	"go/token"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// injectedFileName is the name of the synthetic file that code injected
+// into the main function is attributed to. Like the compiler's
+// "<autogenerated>", it makes clear that the code doesn't exist in
+// any source file.
+const injectedFileName = "<goprofile>"
+
+// newProfileStmts returns ast nodes equivalent to the following code:
+//
+//	if !goprofileStart() {
+//		return
+//	}
+//	defer goprofileRecover()
+//
+// goprofileStart and goprofileRecover are defined in the support file
+// (see support.go). In the generated code, "goprofile" is replaced by
+// prefix. The nodes are positioned in a synthetic file named
+// injectedFileName that is added to fs.
+//
+// Like all identifiers the injected code refers to, goprofileStart and
+// goprofileRecover double as sentinels marking the code as injected by
+// goprofile (see injectedName and Strip).
+func newProfileStmts(fs *token.FileSet, prefix string) []ast.Stmt {
+	f := fs.AddFile(injectedFileName, -1, 4)
+	f.SetLines([]int{0, 1, 2, 3})
+	line := func(n int) token.Pos {
+		return f.LineStart(n)
+	}
+
+	return []ast.Stmt{
+		&ast.IfStmt{
+			If: line(1),
+			Cond: &ast.UnaryExpr{
+				OpPos: line(1),
+				Op:    token.NOT,
+				X: &ast.CallExpr{
+					Fun: &ast.Ident{Name: prefix + "Start", NamePos: line(1)},
+				},
+			},
+			Body: &ast.BlockStmt{
+				Lbrace: line(1),
+				List: []ast.Stmt{
+					&ast.ReturnStmt{Return: line(2)},
+				},
+				Rbrace: line(3),
+			},
+		},
+		&ast.DeferStmt{
+			Defer: line(4),
+			Call: &ast.CallExpr{
+				Fun: &ast.Ident{Name: prefix + "Recover", NamePos: line(4)},
+			},
+		},
+	}
+}
+
+func isMain(fun *ast.FuncDecl) bool {
+	return fun.Name.Name == "main" &&
+		fun.Recv == nil &&
+		fun.Type.Params.NumFields() == 0 &&
+		fun.Type.Results == nil
+}
+
+// HasMain determines whether the given file ast declares the main function
+// of a main package.
+func HasMain(file *ast.File) bool {
+	var foundMain bool
+	inspector := func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.File:
+			if node.Name.Name != "main" {
+				return false
+			}
+		case *ast.FuncDecl:
+			if isMain(node) {
+				foundMain = true
+				return false
+			}
+		}
+
+		return true
+	}
+	ast.Inspect(file, inspector)
+	return foundMain
+}
+
+// hasImport determines whether the given file imports the package
+// at path.
+func hasImport(file *ast.File, path string) bool {
+	var foundImport bool
+	inspector := func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.ImportSpec:
+			if node.Path.Value == path {
+				foundImport = true
+				return false
+			}
+		}
+		return true
+	}
+	ast.Inspect(file, inspector)
+	return foundImport
+}
+
+// exitFuncs maps the import paths of packages to those of their functions
+// that terminate the program without running deferred calls. Each function
+// is mapped to its replacement in the support file, minus the prefix of
+// the identifiers added by goprofile (e.g. goprofileExit).
+var exitFuncs = map[string]map[string]string{
+	`"os"`: {
+		"Exit": "Exit",
+	},
+	`"log"`: {
+		"Fatal":   "Fatal",
+		"Fatalf":  "Fatalf",
+		"Fatalln": "Fatalln",
+	},
+}
+
+// exitVia maps the import paths of the packages in exitFuncs to the function
+// of the package that the replacements are passed as their first argument,
+// and call instead of referring to the package themselves: os.Exit and
+// log.Output. Passing it keeps the import used, under its original name.
+var exitVia = map[string]string{
+	`"os"`:  "Exit",
+	`"log"`: "Output",
+}
+
+// importName returns the name under which the given import is
+// accessible in the importing file.
+func importName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	p, err := strconv.Unquote(spec.Path.Value)
+	if err != nil {
+		return ""
+	}
+	return path.Base(p)
+}
+
+// isPkgRef determines whether expr is a reference to the
+// package imported under the given name.
+func isPkgRef(expr ast.Expr, name string) bool {
+	ident, ok := expr.(*ast.Ident)
+	// Identifiers referring to packages are never resolved by the parser.
+	// If ident is resolved, it refers to a declaration shadowing the import.
+	return ok && ident.Name == name && ident.Obj == nil
+}
+
+// rewriteExits replaces calls to the functions in exitFuncs with calls
+// to their replacements in the support file, so that profiles are
+// written before the program exits, e.g. log.Fatal(err) with
+// goprofileFatal(log.Output, err) (see exitVia). prefix is the prefix
+// of the identifiers declared by the support file. rewriteExits returns
+// whether it changed the given file ast.
+func rewriteExits(file *ast.File, prefix string) bool {
+	if file.Name.Name != "main" {
+		return false
+	}
+
+	var changed bool
+	for _, spec := range file.Imports {
+		funcs, ok := exitFuncs[spec.Path.Value]
+		if !ok {
+			continue
+		}
+		name := importName(spec)
+		if name == "_" || name == "." {
+			continue
+		}
+
+		ast.Inspect(file, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || !isPkgRef(sel.X, name) {
+				return true
+			}
+			if replacement, ok := funcs[sel.Sel.Name]; ok {
+				via := &ast.SelectorExpr{
+					X:   &ast.Ident{Name: name, NamePos: sel.Pos()},
+					Sel: &ast.Ident{Name: exitVia[spec.Path.Value], NamePos: sel.Pos()},
+				}
+				call.Fun = &ast.Ident{Name: prefix + replacement, NamePos: sel.Pos()}
+				call.Args = append([]ast.Expr{via}, call.Args...)
+				changed = true
+			}
+			return true
+		})
+	}
+	return changed
+}
+
+// funcName returns the name of the function declared by fun as it appears in
+// profiles, e.g. "main.run", "main.(*server).handle", "main.handler.ServeHTTP"
+// or "main.apply[...]".
+func funcName(pkg string, fun *ast.FuncDecl) string {
+	if fun.Recv == nil || len(fun.Recv.List) == 0 {
+		if fun.Type.TypeParams != nil && len(fun.Type.TypeParams.List) > 0 {
+			return pkg + "." + fun.Name.Name + "[...]"
+		}
+		return pkg + "." + fun.Name.Name
+	}
+	recv := fun.Recv.List[0].Type
+	star := false
+	if s, ok := recv.(*ast.StarExpr); ok {
+		recv, star = s.X, true
+	}
+	var typeName string
+	switch r := recv.(type) {
+	case *ast.Ident:
+		typeName = r.Name
+	case *ast.IndexExpr:
+		typeName = typeNameOf(r.X) + "[...]"
+	case *ast.IndexListExpr:
+		typeName = typeNameOf(r.X) + "[...]"
+	}
+	if star {
+		return pkg + ".(*" + typeName + ")." + fun.Name.Name
+	}
+	return pkg + "." + typeName + "." + fun.Name.Name
+}
+
+func typeNameOf(expr ast.Expr) string {
+	if ident, ok := expr.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+// contextParam returns the name of the first parameter of fun of type
+// context.Context, or "" if there is none.
+func contextParam(file *ast.File, fun *ast.FuncDecl) string {
+	var pkgName string
+	for _, spec := range file.Imports {
+		if spec.Path.Value == `"context"` {
+			pkgName = importName(spec)
+		}
+	}
+	if pkgName == "" || pkgName == "_" || pkgName == "." {
+		return ""
+	}
+	for _, field := range fun.Type.Params.List {
+		sel, ok := field.Type.(*ast.SelectorExpr)
+		if !ok || !isPkgRef(sel.X, pkgName) || sel.Sel.Name != "Context" {
+			continue
+		}
+		for _, name := range field.Names {
+			if name.Name != "_" {
+				return name.Name
+			}
+		}
+	}
+	return ""
+}
+
+// newLabelStmt returns an ast node equivalent to the following code:
+//
+//	defer goprofileLabel(ctx, "name")()
+//
+// goprofileLabel is defined in the support file. It labels the calling
+// goroutine like pprof.Do does, and the returned function restores the
+// labels the goroutine had before. If ctx is empty, nil is passed instead. As in
+// newProfileStmts, "goprofile" is replaced by prefix.
+func newLabelStmt(pos token.Pos, prefix, ctx, name string) ast.Stmt {
+	var ctxExpr ast.Expr = &ast.Ident{Name: "nil", NamePos: pos}
+	if ctx != "" {
+		ctxExpr = &ast.Ident{Name: ctx, NamePos: pos}
+	}
+	return &ast.DeferStmt{
+		Defer: pos,
+		Call: &ast.CallExpr{
+			Fun: &ast.CallExpr{
+				Fun: &ast.Ident{Name: prefix + "Label", NamePos: pos},
+				Args: []ast.Expr{
+					ctxExpr,
+					&ast.BasicLit{ValuePos: pos, Kind: token.STRING, Value: strconv.Quote(name)},
+				},
+			},
+		},
+	}
+}
+
+// addLabels makes every function declared in the given file ast whose name
+// (as returned by funcName) matches re label the goroutine executing it with
+// the pprof label "func", so that profiles can be sliced by function with
+// e.g. 'go tool pprof -tagfocus'. If the function has a context.Context
+// parameter, the labels of the context are retained. addLabels returns the
+// names of the labeled functions. fs is the file set the file ast belongs
+// to, prefix the prefix of the identifiers declared by the support file.
+func addLabels(fs *token.FileSet, file *ast.File, re *regexp.Regexp, prefix string) []string {
+	if file.Name.Name != "main" {
+		return nil
+	}
+
+	var pos token.Pos
+	var labeled []string
+	for _, decl := range file.Decls {
+		fun, ok := decl.(*ast.FuncDecl)
+		if !ok || fun.Body == nil {
+			continue
+		}
+		name := funcName(file.Name.Name, fun)
+		if !re.MatchString(name) {
+			continue
+		}
+		if !pos.IsValid() {
+			f := fs.AddFile(injectedFileName, -1, 1)
+			pos = f.LineStart(1)
+		}
+		stmt := newLabelStmt(pos, prefix, contextParam(file, fun), name)
+		fun.Body.List = append([]ast.Stmt{stmt}, fun.Body.List...)
+		labeled = append(labeled, name)
+	}
+	return labeled
+}
+
+// hasIdentWithPrefix determines whether the given file ast contains an
+// identifier starting with prefix.
+func hasIdentWithPrefix(file *ast.File, prefix string) bool {
+	var found bool
+	ast.Inspect(file, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok && strings.HasPrefix(ident.Name, prefix) {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// instrument adds calls to the profiling code in the support file to
+// the main function of the given file ast. fs is the file set the file
+// ast belongs to, prefix the prefix of the identifiers declared by the
+// support file.
+func instrument(fs *token.FileSet, file *ast.File, prefix string) {
+	inspector := func(node ast.Node) bool {
+		if node, ok := node.(*ast.FuncDecl); ok && isMain(node) {
+			newBodyList := newProfileStmts(fs, prefix)
+			newBodyList = append(newBodyList, node.Body.List...)
+			node.Body.List = newBodyList
+		}
+		return true
+	}
+	ast.Inspect(file, inspector)
+}
+
+// injectedPattern matches the identifiers declared by the support file that
+// injected code refers to, for any prefix chosen by choosePrefix.
+var injectedPattern = regexp.MustCompile(`^` + DefaultPrefix + `[0-9]*(Start|Recover|Label|Exit|Fatal|Fatalf|Fatalln)$`)
+
+// injectedName returns the name of the support file function that expr refers
+// to without the prefix (e.g. "Start" for goprofile2Start), or "" if expr
+// isn't such a reference.
+func injectedName(expr ast.Expr) string {
+	ident, ok := expr.(*ast.Ident)
+	if !ok || ident.Obj != nil {
+		return ""
+	}
+	if m := injectedPattern.FindStringSubmatch(ident.Name); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// isProfileStmts determines whether the given statements start with
+// statements generated by newProfileStmts.
+func isProfileStmts(stmts []ast.Stmt) bool {
+	if len(stmts) < 2 {
+		return false
+	}
+	ifStmt, ok := stmts[0].(*ast.IfStmt)
+	if !ok || ifStmt.Init != nil || ifStmt.Else != nil || len(ifStmt.Body.List) != 1 {
+		return false
+	}
+	cond, ok := ifStmt.Cond.(*ast.UnaryExpr)
+	if !ok || cond.Op != token.NOT {
+		return false
+	}
+	start, ok := cond.X.(*ast.CallExpr)
+	if !ok || len(start.Args) != 0 || injectedName(start.Fun) != "Start" {
+		return false
+	}
+	if ret, ok := ifStmt.Body.List[0].(*ast.ReturnStmt); !ok || len(ret.Results) != 0 {
+		return false
+	}
+	deferStmt, ok := stmts[1].(*ast.DeferStmt)
+	return ok && len(deferStmt.Call.Args) == 0 && injectedName(deferStmt.Call.Fun) == "Recover"
+}
+
+// isLabelStmt determines whether stmt was generated by newLabelStmt.
+func isLabelStmt(stmt ast.Stmt) bool {
+	deferStmt, ok := stmt.(*ast.DeferStmt)
+	if !ok || len(deferStmt.Call.Args) != 0 {
+		return false
+	}
+	label, ok := deferStmt.Call.Fun.(*ast.CallExpr)
+	return ok && len(label.Args) == 2 && injectedName(label.Fun) == "Label"
+}
+
+// closeGap moves the opening brace of body to the line before the first
+// statement or comment in it, so that printing the body doesn't leave an
+// empty line where statements were removed from its beginning.
+func closeGap(fs *token.FileSet, file *ast.File, body *ast.BlockStmt) {
+	next := body.Rbrace
+	if len(body.List) > 0 {
+		next = body.List[0].Pos()
+	}
+	for _, group := range file.Comments {
+		if group.Pos() > body.Lbrace && group.Pos() < next {
+			next = group.Pos()
+			break
+		}
+	}
+	f := fs.File(next)
+	if f == nil || f != fs.File(body.Lbrace) {
+		return
+	}
+	if line := f.Line(next); line-1 > f.Line(body.Lbrace) {
+		body.Lbrace = f.LineStart(line - 1)
+	}
+}
+
+// Strip removes the code goprofile injected into the given file ast, with
+// any prefix: the statements added to main() and to labeled functions are
+// removed, and the calls rewritten by rewriteExits are restored. Strip
+// returns whether it changed the given file ast. fs is the file set the file
+// ast belongs to.
+func Strip(fs *token.FileSet, file *ast.File) bool {
+	if file.Name.Name != "main" {
+		return false
+	}
+
+	var changed bool
+	for _, decl := range file.Decls {
+		fun, ok := decl.(*ast.FuncDecl)
+		if !ok || fun.Body == nil {
+			continue
+		}
+		var removed bool
+		for {
+			if isMain(fun) && isProfileStmts(fun.Body.List) {
+				fun.Body.List = fun.Body.List[2:]
+			} else if len(fun.Body.List) > 0 && isLabelStmt(fun.Body.List[0]) {
+				fun.Body.List = fun.Body.List[1:]
+			} else {
+				break
+			}
+			removed = true
+		}
+		if removed {
+			closeGap(fs, file, fun.Body)
+			changed = true
+		}
+	}
+
+	// maps the replacements of exit functions to the package and function
+	// they replace, e.g. "Fatalf" to "log" and "Fatalf"
+	replaced := make(map[string][2]string)
+	for path, funcs := range exitFuncs {
+		for name, replacement := range funcs {
+			replaced[replacement] = [2]string{path, name}
+		}
+	}
+	ast.Inspect(file, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		orig, ok := replaced[injectedName(call.Fun)]
+		if !ok {
+			return true
+		}
+		// The first argument names the package, e.g. stdlog.Output.
+		via, ok := call.Args[0].(*ast.SelectorExpr)
+		if !ok || via.Sel.Name != exitVia[orig[0]] {
+			return true
+		}
+		call.Fun = &ast.SelectorExpr{X: via.X, Sel: &ast.Ident{Name: orig[1], NamePos: via.Sel.Pos()}}
+		call.Args = call.Args[1:]
+		changed = true
+		return true
+	})
+	return changed
+}
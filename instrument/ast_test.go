@@ -0,0 +1,558 @@
+package instrument
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var tests = []struct {
+	src            string
+	hasMain        bool
+	hasPProfImport bool
+}{
+	{`
+	package main
+
+	func main() {}
+	`, true, false},
+	{`
+	package moo
+
+	import "runtime/pprof"
+
+	func main() {}
+	`, false, true},
+	{`
+	package main
+
+	import (
+		"foo"
+		"runtime/pprof"
+		"baz"
+	)
+
+	func main(args []string) {}
+	`, false, true},
+	{`
+	package main
+
+	import "pprof"
+
+	func main() int {}
+	`, false, false},
+	{`
+	package main
+
+	import (
+		"foo"
+		"baz"
+		"bar"
+	)
+	import "heh"
+	import "runtime/pprof"
+
+	type Bar struct{}
+
+	func (Bar b) main() {}
+	`, false, true},
+}
+
+func parse(t *testing.T, src string) *ast.File {
+	fileset := token.NewFileSet()
+	ast, err := parser.ParseFile(fileset, "", strings.NewReader(src), parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ast
+}
+
+func TestHasMain(t *testing.T) {
+	t.Parallel()
+	for _, test := range tests {
+		ast := parse(t, test.src)
+		if hm := HasMain(ast); hm != test.hasMain {
+			t.Fatalf("expected %v, got %v\nSource code:%s", test.hasMain, hm, test.src)
+		}
+	}
+}
+
+func TestHasImport(t *testing.T) {
+	t.Parallel()
+	for _, test := range tests {
+		ast := parse(t, test.src)
+		if hi := hasImport(ast, `"runtime/pprof"`); hi != test.hasPProfImport {
+			t.Fatalf("expected %v, got %v\nSource code:%s", test.hasPProfImport, hi, test.src)
+		}
+	}
+}
+
+func testInstrument(t *testing.T, srcOrig, srcExpected string) {
+	bufExpected := &bytes.Buffer{}
+	bufActual := &bytes.Buffer{}
+
+	astExpected := parse(t, srcExpected)
+	astActual := parse(t, srcOrig)
+	instrument(token.NewFileSet(), astActual, DefaultPrefix)
+
+	printer.Fprint(bufExpected, token.NewFileSet(), astExpected)
+	printer.Fprint(bufActual, token.NewFileSet(), astActual)
+	if !bytes.Equal(bufExpected.Bytes(), bufActual.Bytes()) {
+		t.Fatalf("Expected:\n%s\n Actual:\n%s\n", bufExpected.String(), bufActual.String())
+	}
+
+}
+
+func TestInstrument1(t *testing.T) {
+	t.Parallel()
+	srcOrig := `
+	package main
+
+	func main() {
+		fmt.Println("abc")
+	}`
+	srcExpected := `
+	package main
+
+	func main() {
+		if !goprofileStart() {
+			return
+		}
+		defer goprofileRecover()
+		fmt.Println("abc")
+	}`
+	testInstrument(t, srcOrig, srcExpected)
+}
+
+func TestInstrumentImportsUntouched(t *testing.T) {
+	t.Parallel()
+	srcOrig := `
+	package main
+
+	import (
+		"bla"
+		"os"
+		"bork"
+		"runtime/pprof"
+		"fmt"
+	)
+	func main() {
+		fmt.Println("abc")
+	}`
+	srcExpected := `
+	package main
+
+	import (
+		"bla"
+		"os"
+		"bork"
+		"runtime/pprof"
+		"fmt"
+	)
+	func main() {
+		if !goprofileStart() {
+			return
+		}
+		defer goprofileRecover()
+		fmt.Println("abc")
+	}`
+	testInstrument(t, srcOrig, srcExpected)
+}
+
+func TestInstrumentOnlyMain(t *testing.T) {
+	t.Parallel()
+	srcOrig := `
+	package main
+
+	type Bar struct{}
+
+	func (b Bar) main() {}
+
+	func main() {
+		Bar{}.main()
+	}
+
+	func helper() {}
+	`
+	srcExpected := `
+	package main
+
+	type Bar struct{}
+
+	func (b Bar) main() {}
+
+	func main() {
+		if !goprofileStart() {
+			return
+		}
+		defer goprofileRecover()
+		Bar{}.main()
+	}
+
+	func helper() {}
+	`
+	testInstrument(t, srcOrig, srcExpected)
+}
+
+func testRewriteExits(t *testing.T, srcOrig, srcExpected string, expectChange bool) {
+	bufExpected := &bytes.Buffer{}
+	bufActual := &bytes.Buffer{}
+
+	astExpected := parse(t, srcExpected)
+	astActual := parse(t, srcOrig)
+	if changed := rewriteExits(astActual, DefaultPrefix); changed != expectChange {
+		t.Fatalf("expected change %v, got %v\nSource code:%s", expectChange, changed, srcOrig)
+	}
+
+	printer.Fprint(bufExpected, token.NewFileSet(), astExpected)
+	printer.Fprint(bufActual, token.NewFileSet(), astActual)
+	if !bytes.Equal(bufExpected.Bytes(), bufActual.Bytes()) {
+		t.Fatalf("Expected:\n%s\n Actual:\n%s\n", bufExpected.String(), bufActual.String())
+	}
+}
+
+func TestRewriteExits(t *testing.T) {
+	t.Parallel()
+	srcOrig := `
+	package main
+
+	import (
+		"fmt"
+		"log"
+		"os"
+	)
+
+	func fail(err error) {
+		if err != nil {
+			log.Fatalf("failed: %s", err)
+		}
+		fmt.Fprintln(os.Stderr, "done")
+		defer os.Exit(3)
+	}`
+	srcExpected := `
+	package main
+
+	import (
+		"fmt"
+		"log"
+		"os"
+	)
+
+	func fail(err error) {
+		if err != nil {
+			goprofileFatalf(log.Output, "failed: %s", err)
+		}
+		fmt.Fprintln(os.Stderr, "done")
+		defer goprofileExit(os.Exit, 3)
+	}`
+	testRewriteExits(t, srcOrig, srcExpected, true)
+}
+
+func TestRewriteExitsAliasAndShadow(t *testing.T) {
+	t.Parallel()
+	srcOrig := `
+	package main
+
+	import (
+		stdlog "log"
+		oss "os"
+	)
+
+	type logger struct{}
+
+	func (logger) Fatal(v ...interface{}) {}
+
+	func main() {
+		stdlog.Fatalln("bye")
+		log := logger{}
+		log.Fatal("not the log package")
+		oss.Exit(1)
+	}`
+	srcExpected := `
+	package main
+
+	import (
+		stdlog "log"
+		oss "os"
+	)
+
+	type logger struct{}
+
+	func (logger) Fatal(v ...interface{}) {}
+
+	func main() {
+		goprofileFatalln(stdlog.Output, "bye")
+		log := logger{}
+		log.Fatal("not the log package")
+		goprofileExit(oss.Exit, 1)
+	}`
+	testRewriteExits(t, srcOrig, srcExpected, true)
+}
+
+func TestRewriteExitsNoChange(t *testing.T) {
+	t.Parallel()
+	for _, src := range []string{`
+	package main
+
+	import "os"
+
+	func main() {
+		os.Stdout.WriteString("no exit")
+	}`, `
+	package foo
+
+	import "os"
+
+	func Exit() {
+		os.Exit(1)
+	}`,
+	} {
+		testRewriteExits(t, src, src, false)
+	}
+}
+
+func TestAddLabels(t *testing.T) {
+	t.Parallel()
+	srcOrig := `
+	package main
+
+	import stdctx "context"
+
+	type server struct{}
+
+	func (s *server) handle(_ int, ctx stdctx.Context) error {
+		return nil
+	}
+
+	func (server) handleAll() {}
+
+	func run() {}
+
+	func main() {
+		run()
+	}`
+	srcExpected := `
+	package main
+
+	import stdctx "context"
+
+	type server struct{}
+
+	func (s *server) handle(_ int, ctx stdctx.Context) error {
+		defer goprofileLabel(ctx, "main.(*server).handle")()
+		return nil
+	}
+
+	func (server) handleAll() {
+		defer goprofileLabel(nil, "main.server.handleAll")()
+	}
+
+	func run() {}
+
+	func main() {
+		run()
+	}`
+
+	bufExpected := &bytes.Buffer{}
+	bufActual := &bytes.Buffer{}
+
+	astExpected := parse(t, srcExpected)
+	astActual := parse(t, srcOrig)
+	if len(addLabels(token.NewFileSet(), astActual, regexp.MustCompile(`server.*\.handle`), DefaultPrefix)) == 0 {
+		t.Fatalf("expected change\nSource code:%s", srcOrig)
+	}
+
+	printer.Fprint(bufExpected, token.NewFileSet(), astExpected)
+	printer.Fprint(bufActual, token.NewFileSet(), astActual)
+	if !bytes.Equal(bufExpected.Bytes(), bufActual.Bytes()) {
+		t.Fatalf("Expected:\n%s\n Actual:\n%s\n", bufExpected.String(), bufActual.String())
+	}
+}
+
+func TestFuncName(t *testing.T) {
+	t.Parallel()
+	src := `
+	package main
+
+	func run() {}
+	func (s *server) handle() {}
+	func (h handler) ServeHTTP() {}
+	func (l *list[T]) push() {}
+	func (m pair[K, V]) key() {}
+	func apply[T any](x T) {}`
+	expected := []string{
+		"main.run",
+		"main.(*server).handle",
+		"main.handler.ServeHTTP",
+		"main.(*list[...]).push",
+		"main.pair[...].key",
+		"main.apply[...]",
+	}
+	file := parse(t, src)
+	for i, decl := range file.Decls {
+		if name := funcName("main", decl.(*ast.FuncDecl)); name != expected[i] {
+			t.Fatalf("expected %s, got %s", expected[i], name)
+		}
+	}
+}
+
+func TestInstrumentLineDirectives(t *testing.T) {
+	t.Parallel()
+	src := `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("abc")
+}
+`
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "/src/main.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instrument(fs, file, DefaultPrefix)
+
+	buf := &bytes.Buffer{}
+	if err := lineDirectivePrinter.Fprint(buf, fs, file); err != nil {
+		t.Fatal(err)
+	}
+	var directives []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "//line ") {
+			directives = append(directives, line)
+		}
+	}
+	expected := []string{
+		"//line /src/main.go:1",
+		"//line <goprofile>:1",
+		"//line /src/main.go:6",
+	}
+	if strings.Join(directives, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected directives %v, got %v\n%s", expected, directives, buf.String())
+	}
+}
+
+func TestStrip(t *testing.T) {
+	t.Parallel()
+	src := `package main
+
+import (
+	"context"
+	"log"
+	"os"
+)
+
+// main runs.
+func main() {
+	// the work
+	run(context.Background())
+	os.Exit(len(os.Args))
+}
+
+func run(ctx context.Context) {
+	if ctx == nil {
+		log.Fatalln("no context")
+	}
+}
+`
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "main.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// instrumented twice, as by an older version of goprofile
+	for _, prefix := range []string{"goprofile", "goprofile2"} {
+		addLabels(fs, file, regexp.MustCompile(`main\.run`), prefix)
+		instrument(fs, file, prefix)
+		rewriteExits(file, prefix)
+	}
+	buf := &bytes.Buffer{}
+	if err := format.Node(buf, fs, file); err != nil {
+		t.Fatal(err)
+	}
+
+	// reparse, like goprofile -strip does
+	fs = token.NewFileSet()
+	file, err = parser.ParseFile(fs, "main.go", buf.String(), parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Strip(fs, file) {
+		t.Fatalf("expected change\nSource code:%s", buf.String())
+	}
+	stripped := &bytes.Buffer{}
+	if err := format.Node(stripped, fs, file); err != nil {
+		t.Fatal(err)
+	}
+	if stripped.String() != src {
+		t.Fatalf("Expected:\n%s\n Actual:\n%s\n", src, stripped.String())
+	}
+	if Strip(fs, file) {
+		t.Fatal("expected stripping twice not to change anything")
+	}
+}
+
+func TestStripAliasedImports(t *testing.T) {
+	t.Parallel()
+	src := `package main
+
+import (
+	stdlog "log"
+	oss "os"
+)
+
+func main() {
+	if len(oss.Args) > 1 {
+		stdlog.Fatalf("unexpected arguments %v", oss.Args[1:])
+	}
+	oss.Exit(0)
+}
+`
+	instrumented, _, err := New(Options{}).Source("main.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, "main.go", instrumented, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Strip(fs, file) {
+		t.Fatalf("expected change\nSource code:%s", instrumented)
+	}
+	stripped := &bytes.Buffer{}
+	if err := format.Node(stripped, fs, file); err != nil {
+		t.Fatal(err)
+	}
+	if stripped.String() != src {
+		t.Fatalf("Expected:\n%s\n Actual:\n%s\n", src, stripped.String())
+	}
+}
+
+func TestStripKeepsOwnDeclarations(t *testing.T) {
+	t.Parallel()
+	// goprofileStart is declared by the program itself
+	src := `
+	package main
+
+	func goprofileStart() bool { return true }
+
+	func goprofileRecover() {}
+
+	func main() {
+		if !goprofileStart() {
+			return
+		}
+		defer goprofileRecover()
+	}`
+	if Strip(token.NewFileSet(), parse(t, src)) {
+		t.Fatalf("expected no change\nSource code:%s", src)
+	}
+}
@@ -0,0 +1,340 @@
+// Package instrument implements the source transformations of goprofile.
+//
+// An Instrumenter injects calls to profiling code into the main function of a
+// program, so that the profiles are started when main() starts and written
+// when it returns. Calls to os.Exit and log.Fatal, which would keep them from
+// being written, are rewritten to call replacements writing them first, and
+// functions can be labeled with pprof labels. The profiling code itself is
+// declared by a support file, whose source SupportSource returns, and which
+// has to be added to the instrumented package. The identifiers the injected
+// code refers to start with a prefix, which must be the same for both: the
+// Prefix of the Package returned by Instrumenter.Files and Instrumenter.Dir.
+//
+// For example, a tool could instrument the main package in the directory
+// cmd/server as follows:
+//
+//	pkg, err := instrument.New(instrument.Options{}).Dir("cmd/server")
+//	if err != nil {
+//		return err
+//	}
+//	for _, f := range pkg.Files {
+//		// write f.Source in place of f.Path, e.g. with 'go build -overlay'
+//	}
+//	src, err := instrument.SupportSource(instrument.SupportConfig{
+//		Prefix:   pkg.Prefix,
+//		ProfFile: "server.pprof",
+//		Profiles: []string{"cpu"},
+//		Signals:  !pkg.HandlesSignals,
+//	})
+//	// add src to the package as instrument.SupportFileName(pkg.Prefix)
+//
+// Code injected by an earlier instrumentation is replaced rather than
+// injected twice, and can be removed with Strip.
+package instrument
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// lineDirectivePrinter prints file asts with //line directives, so that
+// positions in the compiled program (e.g. in profiles) refer to the
+// original source files rather than to their instrumented copies.
+var lineDirectivePrinter = &printer.Config{Mode: printer.SourcePos | printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+
+// Options configure an Instrumenter.
+type Options struct {
+	// Prefix is the prefix of the identifiers the injected code refers to,
+	// which must be that of the support file. If it is empty, Files and Dir
+	// choose a prefix not used by the package yet, and File and Source use
+	// DefaultPrefix.
+	Prefix string
+	// Label selects the functions that label the goroutines executing them
+	// with the pprof label "func", by their names as they appear in profiles
+	// (e.g. "main.(*server).handle"). If it is nil, no function is labeled.
+	Label *regexp.Regexp
+	// LineDirectives makes Source print the instrumented source with //line
+	// directives, so that positions in the compiled program (e.g. in
+	// profiles) refer to the original file even if the instrumented source
+	// is compiled from another location. Otherwise, the instrumented source
+	// is formatted like gofmt does.
+	LineDirectives bool
+	// Context is the build context Dir selects the files of the package
+	// with, e.g. for other build tags, operating systems or architectures.
+	// If it is nil, build.Default is used.
+	Context *build.Context
+}
+
+// An Instrumenter instruments go source files according to its options.
+// It doesn't write any file.
+type Instrumenter struct {
+	options Options
+}
+
+// New returns an Instrumenter with the given options.
+func New(options Options) *Instrumenter {
+	return &Instrumenter{options: options}
+}
+
+func (in *Instrumenter) prefix() string {
+	if in.options.Prefix == "" {
+		return DefaultPrefix
+	}
+	return in.options.Prefix
+}
+
+// A Result describes the changes an Instrumenter made to a file.
+type Result struct {
+	// Main is set if the file declares the main function of a main
+	// package, which was instrumented.
+	Main bool
+	// Stripped is set if code injected by an earlier instrumentation
+	// was removed before the file was instrumented again.
+	Stripped bool
+	// Labeled lists the names of the functions that were labeled.
+	Labeled []string
+	// RewroteExits is set if calls to os.Exit or log.Fatal were rewritten.
+	RewroteExits bool
+	// Warnings describes problems that don't keep the file from being
+	// instrumented, but might keep the profiles from being written.
+	Warnings []string
+}
+
+// Changed determines whether the instrumented file differs from the
+// original one.
+func (r *Result) Changed() bool {
+	return r.Main || r.Stripped || len(r.Labeled) > 0 || r.RewroteExits
+}
+
+// File instruments the given file ast, which belongs to fs: code injected by
+// an earlier instrumentation is stripped, the functions selected by the Label
+// option are labeled, the main function is instrumented and calls terminating
+// the program are rewritten.
+func (in *Instrumenter) File(fs *token.FileSet, file *ast.File) *Result {
+	prefix := in.prefix()
+	res := &Result{Stripped: Strip(fs, file)}
+	if in.options.Label != nil {
+		res.Labeled = addLabels(fs, file, in.options.Label, prefix)
+	}
+	res.Main = HasMain(file)
+	if res.Main {
+		if hasImport(file, `"runtime/pprof"`) {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("%s imports runtime/pprof. Only one cpu profile can be "+
+				"collected at a time; if the program starts one itself, either it or goprofile fails to.",
+				fs.Position(file.Package).Filename))
+		}
+		instrument(fs, file, prefix)
+	}
+	res.RewroteExits = rewriteExits(file, prefix)
+	return res
+}
+
+// Source instruments the go source file named filename (see File). If src is
+// nil, the file is read from filename; otherwise src holds its contents.
+// Source returns the instrumented source, or the original one if the file
+// wasn't changed. With the LineDirectives option, the directives refer to the
+// absolute path of filename.
+func (in *Instrumenter) Source(filename string, src []byte) ([]byte, *Result, error) {
+	if src == nil {
+		var err error
+		if src, err = ioutil.ReadFile(filename); err != nil {
+			return nil, nil, err
+		}
+	}
+	if in.options.LineDirectives {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		filename = abs
+	}
+
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Parser error: %s", err)
+	}
+	res := in.File(fs, file)
+	if !res.Changed() {
+		return src, res, nil
+	}
+
+	var buf bytes.Buffer
+	if in.options.LineDirectives {
+		err = lineDirectivePrinter.Fprint(&buf, fs, file)
+	} else {
+		err = format.Node(&buf, fs, file)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), res, nil
+}
+
+// A Package is an instrumented main package.
+type Package struct {
+	// Prefix is the prefix of the identifiers the injected code refers to.
+	// The support file added to the package must have the same prefix.
+	Prefix string
+	// Files are the instrumented go files of the package.
+	Files []*File
+	// Generated lists the files among the given ones that were generated
+	// by goprofile (see IsGenerated), e.g. a support file left behind by
+	// an earlier instrumentation. They aren't instrumented, and must be
+	// removed from or replaced in the package.
+	Generated []string
+	// HandlesSignals is set if the package imports os/signal. Its support
+	// file shouldn't write the profiles on SIGINT and SIGTERM then (see
+	// SupportConfig), so as not to interfere with the program.
+	HandlesSignals bool
+}
+
+// A File is a go file of an instrumented package.
+type File struct {
+	Path string
+	// Source is the instrumented source of the file, or its original
+	// source if it wasn't changed.
+	Source []byte
+	*Result
+}
+
+// ErrNoMain is returned by Files and Dir if no file declares a main function.
+var ErrNoMain = errors.New("Couldn't find a main() function to instrument")
+
+// A MultipleMainsError is returned by Files and Dir if more than one file
+// declares a main function, e.g. because files of different commands were
+// given.
+type MultipleMainsError struct {
+	// Paths are the paths of the files declaring a main function.
+	Paths []string
+}
+
+func (e *MultipleMainsError) Error() string {
+	return fmt.Sprintf("Found more than one main() function to instrument (in %s)", strings.Join(e.Paths, ", "))
+}
+
+// Files instruments the go files at the given paths, which make up a main
+// package (see Source). Paths not ending in .go are ignored. Exactly one of
+// the files must declare a main function; otherwise, the error is ErrNoMain
+// or a *MultipleMainsError, and no file is instrumented.
+func (in *Instrumenter) Files(paths []string) (*Package, error) {
+	pkg := &Package{}
+	var files []*ast.File
+	var sources [][]byte
+	var mains []string
+	names := make(map[string]bool)
+	for _, path := range paths {
+		if !strings.HasSuffix(path, ".go") {
+			continue
+		}
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fs := token.NewFileSet()
+		file, err := parser.ParseFile(fs, path, src, parser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("Error processing go file %s: Parser error: %s", path, err)
+		}
+		if IsGenerated(file) {
+			pkg.Generated = append(pkg.Generated, path)
+			continue
+		}
+		if HasMain(file) {
+			mains = append(mains, path)
+		}
+		pkg.HandlesSignals = pkg.HandlesSignals || hasImport(file, `"os/signal"`)
+		pkg.Files = append(pkg.Files, &File{Path: path})
+		sources = append(sources, src)
+		// identifiers injected by an earlier run don't count
+		Strip(fs, file)
+		files = append(files, file)
+		names[filepath.Base(path)] = true
+	}
+	switch len(mains) {
+	case 0:
+		return nil, ErrNoMain
+	case 1:
+	default:
+		return nil, &MultipleMainsError{Paths: mains}
+	}
+
+	options := in.options
+	if options.Prefix == "" {
+		options.Prefix = choosePrefix(files, names)
+	}
+	pkg.Prefix = options.Prefix
+	fileIn := New(options)
+	for i, f := range pkg.Files {
+		var err error
+		f.Source, f.Result, err = fileIn.Source(f.Path, sources[i])
+		if err != nil {
+			return nil, fmt.Errorf("Error processing go file %s: %s", f.Path, err)
+		}
+	}
+	return pkg, nil
+}
+
+// Dir instruments the main package in the directory dir like Files does,
+// given the go files that take part in building the package in the build
+// context of the options, as determined by package go/build. Test files aren't
+// instrumented.
+func (in *Instrumenter) Dir(dir string) (*Package, error) {
+	ctxt := in.options.Context
+	if ctxt == nil {
+		ctxt = &build.Default
+	}
+	bp, err := ctxt.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, names := range [][]string{bp.GoFiles, bp.CgoFiles} {
+		for _, name := range names {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	return in.Files(paths)
+}
+
+// IsGenerated determines whether the given file ast is a file generated by
+// goprofile, i.e. a support file, the file of the init package or a file
+// importing it. Its comments must have been parsed.
+func IsGenerated(file *ast.File) bool {
+	return len(file.Comments) > 0 && file.Comments[0].Pos() < file.Package &&
+		file.Comments[0].List[0].Text == SupportFileHeader
+}
+
+// choosePrefix returns a prefix for the identifiers that goprofile adds to
+// the package consisting of the given file asts, such that they don't collide
+// with any identifier in the package: DefaultPrefix if no identifier in the
+// package starts with it, otherwise DefaultPrefix followed by a number, e.g.
+// "goprofile2". The name of the support file must not be taken by any of the
+// files named in names either.
+func choosePrefix(files []*ast.File, names map[string]bool) string {
+	for i := 1; ; i++ {
+		prefix := DefaultPrefix
+		if i > 1 {
+			prefix += strconv.Itoa(i)
+		}
+		taken := names[SupportFileName(prefix)]
+		for _, file := range files {
+			taken = taken || hasIdentWithPrefix(file, prefix)
+		}
+		if !taken {
+			return prefix
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package instrument
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes the given files, mapping names to contents, to a new
+// temporary directory and returns its path.
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "instrument")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSource(t *testing.T) {
+	t.Parallel()
+	src := `package main
+
+import (
+	"os"
+	"runtime/pprof"
+)
+
+func run() {}
+
+func main() {
+	run()
+	pprof.Lookup("heap")
+	os.Exit(1)
+}
+`
+	in := New(Options{Prefix: "goprofile2", Label: regexp.MustCompile(`main\.run`)})
+	out, res, err := in.Source("main.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Main || !res.RewroteExits || res.Stripped || !res.Changed() {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if strings.Join(res.Labeled, ",") != "main.run" {
+		t.Fatalf("expected main.run to be labeled, got %v", res.Labeled)
+	}
+	if len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0], "imports runtime/pprof") {
+		t.Fatalf("expected a warning about runtime/pprof, got %v", res.Warnings)
+	}
+	for _, expected := range []string{
+		"if !goprofile2Start() {",
+		`defer goprofile2Label(nil, "main.run")()`,
+		"goprofile2Exit(os.Exit, 1)",
+	} {
+		if !strings.Contains(string(out), expected) {
+			t.Fatalf("Expected instrumented source to contain %s\n%s", expected, out)
+		}
+	}
+	if strings.Contains(string(out), "//line") {
+		t.Fatalf("Expected no //line directives\n%s", out)
+	}
+
+	// instrumenting again replaces the injected code
+	again, res, err := in.Source("main.go", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Stripped || string(again) != string(out) {
+		t.Fatalf("Expected the same source after instrumenting again, got %+v\n%s", res, again)
+	}
+}
+
+func TestSourceUnchanged(t *testing.T) {
+	t.Parallel()
+	src := []byte("package main\n\nfunc run() {}\n")
+	out, res, err := New(Options{LineDirectives: true}).Source("run.go", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Changed() || string(out) != string(src) {
+		t.Fatalf("Expected no change, got %+v\n%s", res, out)
+	}
+	if _, _, err := New(Options{}).Source("broken.go", []byte("package main\n\nfunc {")); err == nil {
+		t.Fatal("Expected a parser error")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	t.Parallel()
+	dir := writeFiles(t, map[string]string{
+		"main.go":   "package main\n\nimport \"os/signal\"\n\nvar _ = signal.Notify\n\nfunc main() {}\n",
+		"util.go":   "package main\n\nfunc goprofileUtil() {}\n",
+		"README.md": "not go",
+		// left behind by an earlier instrumentation
+		"goprofile2_support.go": SupportFileHeader + "\n\npackage main\n",
+	})
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for _, name := range []string{"main.go", "util.go", "README.md", "goprofile2_support.go"} {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	pkg, err := New(Options{LineDirectives: true}).Files(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// goprofileUtil takes goprofile, and the support file isn't counted
+	if pkg.Prefix != "goprofile2" {
+		t.Fatalf("Expected prefix goprofile2, got %s", pkg.Prefix)
+	}
+	if !pkg.HandlesSignals {
+		t.Fatal("Expected the package to handle signals")
+	}
+	if len(pkg.Generated) != 1 || pkg.Generated[0] != paths[3] {
+		t.Fatalf("Expected %s to be generated, got %v", paths[3], pkg.Generated)
+	}
+	if len(pkg.Files) != 2 {
+		t.Fatalf("Expected 2 files, got %d", len(pkg.Files))
+	}
+	main, util := pkg.Files[0], pkg.Files[1]
+	if main.Path != paths[0] || !main.Main || !strings.Contains(string(main.Source), "goprofile2Start()") ||
+		!strings.Contains(string(main.Source), "//line ") {
+		t.Fatalf("Expected %s to be instrumented with //line directives\n%s", paths[0], main.Source)
+	}
+	if util.Changed() {
+		t.Fatalf("Expected %s not to be changed\n%s", paths[1], util.Source)
+	}
+}
+
+func TestFilesMains(t *testing.T) {
+	t.Parallel()
+	dir := writeFiles(t, map[string]string{
+		"a.go": "package main\n\nfunc main() {}\n",
+		"b.go": "package main\n\nfunc main() {}\n",
+		"c.go": "package main\n\nfunc run() {}\n",
+	})
+	defer os.RemoveAll(dir)
+
+	in := New(Options{})
+	if _, err := in.Files([]string{filepath.Join(dir, "c.go")}); err != ErrNoMain {
+		t.Fatalf("Expected ErrNoMain, got %v", err)
+	}
+	_, err := in.Files([]string{filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go")})
+	if err, ok := err.(*MultipleMainsError); !ok || len(err.Paths) != 2 {
+		t.Fatalf("Expected a MultipleMainsError, got %v", err)
+	}
+}
+
+func TestDir(t *testing.T) {
+	t.Parallel()
+	dir := writeFiles(t, map[string]string{
+		"main.go":      "package main\n\nfunc main() {}\n",
+		"main_test.go": "package main\n\nfunc run() {}\n",
+		"other.go":     "// +build ignore\n\npackage main\n\nfunc main() {}\n",
+		"custom.go":    "// +build custom\n\npackage main\n\nfunc helper() {}\n",
+	})
+	defer os.RemoveAll(dir)
+
+	pkg, err := New(Options{}).Dir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkg.Files) != 1 || filepath.Base(pkg.Files[0].Path) != "main.go" || !pkg.Files[0].Main {
+		t.Fatalf("Expected only main.go to be instrumented, got %+v", pkg.Files)
+	}
+	if pkg.Prefix != DefaultPrefix {
+		t.Fatalf("Expected prefix %s, got %s", DefaultPrefix, pkg.Prefix)
+	}
+
+	ctxt := build.Default
+	ctxt.BuildTags = []string{"custom"}
+	pkg, err = New(Options{Context: &ctxt}).Dir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkg.Files) != 2 || filepath.Base(pkg.Files[0].Path) != "custom.go" {
+		t.Fatalf("Expected custom.go to be selected by its build tag, got %+v", pkg.Files)
+	}
+}
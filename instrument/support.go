@@ -0,0 +1,903 @@
+package instrument
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultPrefix is the prefix of the identifiers that goprofile adds to
+// the instrumented package. If the package already contains identifiers
+// starting with it, another prefix is used (see Instrumenter.Files).
+const DefaultPrefix = "goprofile"
+
+// SupportFileSuffix is the suffix of the name of the file that goprofile
+// adds to the instrumented package. It contains the code that actually
+// starts and stops the profilers; the instrumented main() merely calls
+// into it.
+const SupportFileSuffix = "_support.go"
+
+// SupportFileName returns the name of the support file given the
+// prefix of the identifiers added by goprofile, e.g.
+// "goprofile_support.go".
+func SupportFileName(prefix string) string {
+	return prefix + SupportFileSuffix
+}
+
+// SupportFileHeader is the first line of the support file and of the init
+// package. It identifies the files left behind by instrumenting a package
+// in-place (see IsGenerated).
+const SupportFileHeader = "// Code generated by goprofile. DO NOT EDIT."
+
+// SupportConfig holds the values that are baked into the support file
+// (see SupportSource) and the init package (see InitSource).
+type SupportConfig struct {
+	// Interval is the interval in which the profiles are written
+	// (0 if they are only written when the program exits). Keep
+	// and KeepSize limit the number and total size of the intervals
+	// whose profiles are kept.
+	Interval time.Duration
+	Keep     int
+	KeepSize int64
+	// Prefix replaces "goprofile" in the identifiers declared by the
+	// support file.
+	Prefix   string
+	ProfFile string
+	Profiles []string
+	Trace    bool
+	// CPURate is the rate of the cpu profile in Hz
+	// (0 for pprof's default rate).
+	CPURate int
+	// Delay and Duration limit profiling to a window of the
+	// program's run time (0 means from the start and until the
+	// program exits).
+	Delay    time.Duration
+	Duration time.Duration
+	// ToggleSignal is the name of the signal toggling the cpu
+	// profile (e.g. "SIGUSR1"), or "" if the cpu profile is
+	// collected from the start.
+	ToggleSignal string
+	// HTTP is the address profiles are served at ("" if they aren't).
+	HTTP string
+	// Signals determines whether profiles are written when the program
+	// is terminated by SIGINT or SIGTERM.
+	Signals bool
+	// Init is the import path of the init package, which starts the
+	// profiles while the program is initialized ("" if there is none).
+	Init string
+}
+
+var supportTemplate = template.Must(template.New("support").Parse(SupportFileHeader + `
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+{{- if .HTTP}}
+	"net"
+	"net/http"
+{{- end}}
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+{{- if .Init}}
+
+	goprofileinit {{printf "%q" .Init}}
+{{- end}}
+)
+
+const goprofileOut = {{printf "%q" .ProfFile}}
+
+var goprofileProfiles = []string{ {{- range $i, $kind := .Profiles}}{{if $i}}, {{end}}{{printf "%q" $kind}}{{end -}} }
+
+const goprofileTrace = {{.Trace}}
+
+const goprofileSignals = {{.Signals}}
+
+// Profiling starts goprofileDelay after the program started. If
+// goprofileDuration isn't zero, the profiles are written after profiling
+// for goprofileDuration, while the program keeps running.
+const goprofileDelay = time.Duration({{.Delay.Nanoseconds}})
+
+const goprofileDuration = time.Duration({{.Duration.Nanoseconds}})
+
+const goprofileCPURate = {{.CPURate}}
+
+const goprofileToggle = {{if .ToggleSignal}}true{{else}}false{{end}}
+
+// With a non-zero goprofileInterval, the profiles are written to a new set of
+// files every interval. Only the last goprofileKeep sets of files are kept,
+// and only as many as fit into goprofileKeepSize bytes (0 means no limit).
+const goprofileInterval = time.Duration({{.Interval.Nanoseconds}})
+
+const goprofileKeep = {{.Keep}}
+
+const goprofileKeepSize = {{.KeepSize}}
+
+var goprofileCPUFile, goprofileTraceFile *os.File
+
+var goprofileStopOnce sync.Once
+
+// goprofileMu serializes writing the profiles at the end of an interval
+// and when the program exits. goprofileStopped is set once the program
+// exits.
+var goprofileMu sync.Mutex
+
+var goprofileStopped bool
+
+// goprofilePeriod is the name of the current interval (see
+// goprofileNewPeriod). It is empty if goprofileInterval is zero.
+var goprofilePeriod string
+
+// goprofileLastPeriod and goprofilePeriodSeq are the start time of the last
+// period, formatted for use in file names, and the number of periods that
+// started in the same second.
+var goprofileLastPeriod string
+
+var goprofilePeriodSeq int
+
+// goprofileSnapshots holds the files written in each interval, oldest first.
+var goprofileSnapshots [][]string
+
+// goprofileStartTime is the time {time} in profile paths expands to.
+var goprofileStartTime = time.Now()
+
+// goprofilePath returns the path the profile of the given kind is written to.
+// If the environment variable GOPROFILE_<KIND>_OUT (e.g. GOPROFILE_HEAP_OUT)
+// is set, the profile is written to the path it holds. Otherwise, the cpu
+// profile is written to $GOPROFILE_OUT or, if that isn't set, goprofileOut;
+// all other kinds are written to a file whose name is derived from it, e.g.
+// "foo.heap.pprof". The execution trace (kind "trace") is written to e.g.
+// "foo.trace". Placeholders in the path are expanded by goprofileExpand.
+func goprofilePath(kind string) string {
+	if p := os.Getenv("GOPROFILE_" + strings.ToUpper(kind) + "_OUT"); p != "" {
+		return goprofileExpand(p)
+	}
+	out := goprofileOut
+	if p := os.Getenv("GOPROFILE_OUT"); p != "" {
+		out = p
+	}
+	out = goprofileExpand(out)
+	if kind == "cpu" {
+		return out
+	}
+	ext := filepath.Ext(out)
+	if kind == "trace" {
+		return strings.TrimSuffix(out, ext) + ".trace"
+	}
+	return strings.TrimSuffix(out, ext) + "." + kind + ext
+}
+
+// goprofileExpand replaces the placeholders {pid}, {time}, {hostname} and
+// {exe} in path by the process id, the time the program was started, the
+// host name and the name of the executable (without extension), so that
+// concurrently running instances don't overwrite each other's profiles.
+func goprofileExpand(path string) string {
+	if !strings.Contains(path, "{") {
+		return path
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	exe = filepath.Base(exe)
+	exe = strings.TrimSuffix(exe, filepath.Ext(exe))
+	return strings.NewReplacer(
+		"{pid}", fmt.Sprint(os.Getpid()),
+		"{time}", goprofileStartTime.Format("20060102-150405"),
+		"{hostname}", hostname,
+		"{exe}", exe,
+	).Replace(path)
+}
+
+// goprofileNewPeriod returns the name of a new period starting at t, which
+// is inserted into the names of the files written for it: the start time,
+// followed by a sequence number if earlier periods started in the same
+// second, e.g. "20060102-150405" or "20060102-150405-2". This keeps periods
+// from overwriting each other's files.
+func goprofileNewPeriod(t time.Time) string {
+	period := t.Format("20060102-150405")
+	if period != goprofileLastPeriod {
+		goprofileLastPeriod, goprofilePeriodSeq = period, 1
+		return period
+	}
+	goprofilePeriodSeq++
+	return period + "-" + strconv.Itoa(goprofilePeriodSeq)
+}
+
+// goprofileCreate creates the file the profile of the given kind is written
+// to. With goprofileInterval, the name of the current interval is inserted
+// into the file name, e.g. "foo.20060102-150405.pprof".
+func goprofileCreate(kind string) *os.File {
+	path := goprofilePath(kind)
+	if goprofilePeriod != "" {
+		ext := filepath.Ext(path)
+		path = strings.TrimSuffix(path, ext) + "." + goprofilePeriod + ext
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		os.Stderr.WriteString("Couldn't open " + path + ": " + err.Error() + "\n")
+		return nil
+	}
+	if goprofileInterval > 0 {
+		last := len(goprofileSnapshots) - 1
+		goprofileSnapshots[last] = append(goprofileSnapshots[last], path)
+	}
+	return f
+}
+
+// goprofileStart enables all selected profiles. It returns false if the
+// profiling output couldn't be set up.
+func goprofileStart() bool {
+	if goprofileDelay > 0 {
+		time.AfterFunc(goprofileDelay, func() {
+			goprofileMu.Lock()
+			defer goprofileMu.Unlock()
+			if !goprofileStopped {
+				goprofileSetRates()
+				goprofileBegin(time.Now())
+			}
+		})
+	} else {
+		goprofileSetRates()
+		if !goprofileBegin(time.Now()) {
+			return false
+		}
+	}
+	if goprofileDuration > 0 {
+		time.AfterFunc(goprofileDelay+goprofileDuration, goprofileStop)
+	}
+	if goprofileSignals {
+		goprofileHandleSignals()
+	}
+	if goprofileInterval > 0 {
+		go goprofileRotate()
+	}
+{{- if .ToggleSignal}}
+	goprofileHandleToggle()
+{{- end}}
+{{- if .HTTP}}
+	goprofileServe()
+{{- end}}
+	return true
+}
+
+// goprofileSetRates enables the collection of block and mutex profiles
+// if they are selected.
+func goprofileSetRates() {
+	for _, kind := range goprofileProfiles {
+		switch kind {
+		case "block":
+			runtime.SetBlockProfileRate(1)
+		case "mutex":
+			runtime.SetMutexProfileFraction(1)
+		}
+	}
+}
+
+// goprofileBegin starts the cpu profile (unless it is toggled by a signal)
+// and the execution trace. With goprofileInterval, it begins a new interval
+// starting at now first.
+func goprofileBegin(now time.Time) bool {
+	if goprofileInterval > 0 {
+		goprofilePeriod = goprofileNewPeriod(now)
+		goprofileSnapshots = append(goprofileSnapshots, nil)
+	}
+	for _, kind := range goprofileProfiles {
+		if kind == "cpu" && !goprofileToggle {
+			f := goprofileCreate(kind)
+			if f == nil {
+				return false
+			}
+			if !goprofileRedirect(kind, f) {
+				goprofileStartCPU(f)
+			}
+			goprofileCPUFile = f
+		}
+	}
+	if goprofileTrace {
+		f := goprofileCreate("trace")
+		if f == nil {
+			return false
+		}
+		if !goprofileRedirect("trace", f) {
+			if err := trace.Start(f); err != nil {
+				os.Stderr.WriteString("Couldn't start execution trace: " + err.Error() + "\n")
+				f.Close()
+				return false
+			}
+		}
+		goprofileTraceFile = f
+	}
+	return true
+}
+
+// goprofileRedirect makes the cpu profile or the execution trace (kind
+// "trace") started while the program was initialized write to f, and
+// reports whether it did. It returns false if the profile wasn't started
+// early or has been redirected already.
+func goprofileRedirect(kind string, f *os.File) bool {
+{{- if .Init}}
+	return goprofileinit.Redirect(kind, f)
+{{- else}}
+	return false
+{{- end}}
+}
+
+// goprofileStartCPU starts the cpu profile, writing it to w. If
+// goprofileCPURate is set, samples are taken at that rate (in Hz) instead
+// of pprof's default of 100 Hz. pprof.StartCPUProfile prints a warning
+// then, because it can't set its default rate; the profile records the
+// rate that is actually used.
+func goprofileStartCPU(w io.Writer) error {
+	if goprofileCPURate > 0 {
+		runtime.SetCPUProfileRate(goprofileCPURate)
+	}
+	return pprof.StartCPUProfile(w)
+}
+
+// goprofileRotate writes the profiles at the end of every interval and
+// begins the next one, until the program exits.
+func goprofileRotate() {
+	ticker := time.NewTicker(goprofileInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		goprofileMu.Lock()
+		if goprofileStopped {
+			goprofileMu.Unlock()
+			return
+		}
+		goprofileFlush()
+		goprofilePrune()
+		goprofileBegin(now)
+		goprofileMu.Unlock()
+	}
+}
+
+// goprofilePrune removes the files written in the oldest intervals, until
+// at most goprofileKeep intervals are left and their files take up at most
+// goprofileKeepSize bytes. The files of the last interval are always kept.
+func goprofilePrune() {
+	var size int64
+	sizes := make([]int64, len(goprofileSnapshots))
+	for i, files := range goprofileSnapshots {
+		for _, file := range files {
+			if fi, err := os.Stat(file); err == nil {
+				sizes[i] += fi.Size()
+			}
+		}
+		size += sizes[i]
+	}
+	for len(goprofileSnapshots) > 1 &&
+		(goprofileKeep > 0 && len(goprofileSnapshots) > goprofileKeep ||
+			goprofileKeepSize > 0 && size > goprofileKeepSize) {
+		for _, file := range goprofileSnapshots[0] {
+			os.Remove(file)
+		}
+		size -= sizes[0]
+		goprofileSnapshots, sizes = goprofileSnapshots[1:], sizes[1:]
+	}
+}
+
+// goprofileHandleSignals makes sure that profiles are written when the
+// program is terminated by SIGINT or SIGTERM. After writing the profiles,
+// the signal is raised again with its default disposition, so that the
+// program terminates just like it would have without goprofile. Signals
+// the program was started with ignored (e.g. by nohup) stay ignored.
+func goprofileHandleSignals() {
+	var sigs []os.Signal
+	for _, sig := range []os.Signal{os.Interrupt, syscall.SIGTERM} {
+		if !signal.Ignored(sig) {
+			sigs = append(sigs, sig)
+		}
+	}
+	if len(sigs) == 0 {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	go func() {
+		sig := <-c
+		goprofileStop()
+		signal.Reset(sigs...)
+		if p, err := os.FindProcess(os.Getpid()); err == nil && p.Signal(sig) == nil {
+			// give the signal time to be delivered
+			time.Sleep(time.Second)
+		}
+		// Raising the signal isn't supported on all platforms.
+		os.Exit(1)
+	}()
+}
+
+// goprofileStop stops the cpu profile and the execution trace and writes all
+// other selected profiles. Only the first call has an effect.
+func goprofileStop() {
+	goprofileStopOnce.Do(func() {
+		goprofileMu.Lock()
+		defer goprofileMu.Unlock()
+		goprofileStopped = true
+		goprofileFlush()
+		if goprofileInterval > 0 {
+			goprofilePrune()
+		}
+	})
+}
+
+func goprofileFlush() {
+	if goprofileTraceFile != nil {
+		trace.Stop()
+		goprofileTraceFile.Close()
+		goprofileTraceFile = nil
+	}
+	if goprofileCPUFile != nil {
+		pprof.StopCPUProfile()
+		goprofileCPUFile.Close()
+		goprofileCPUFile = nil
+	}
+	for _, kind := range goprofileProfiles {
+		if kind != "cpu" {
+			goprofileWrite(kind)
+		}
+	}
+}
+
+// goprofileWrite writes the profile of the given kind, which must not be "cpu".
+func goprofileWrite(kind string) {
+	if kind == "heap" || kind == "allocs" {
+		// get up-to-date statistics
+		runtime.GC()
+	}
+	f := goprofileCreate(kind)
+	if f == nil {
+		return
+	}
+	pprof.Lookup(kind).WriteTo(f, 0)
+	f.Close()
+}
+{{- if .ToggleSignal}}
+
+const goprofileToggleSignal = syscall.{{.ToggleSignal}}
+
+// goprofileHandleToggle starts the cpu profile when the program receives
+// goprofileToggleSignal, and stops it when it receives the signal again.
+// Each time, the profiles returned by goprofileToggleProfiles are written
+// as well. The name of a period starting when the signal was received (see
+// goprofileNewPeriod) is inserted into the names of all these files, e.g.
+// "foo.20060102-150405.pprof".
+func goprofileHandleToggle() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, goprofileToggleSignal)
+	go func() {
+		for range c {
+			goprofileMu.Lock()
+			if goprofileStopped {
+				goprofileMu.Unlock()
+				return
+			}
+			goprofilePeriod = goprofileNewPeriod(time.Now())
+			if goprofileCPUFile != nil {
+				pprof.StopCPUProfile()
+				goprofileCPUFile.Close()
+				goprofileCPUFile = nil
+			} else if f := goprofileCreate("cpu"); f != nil {
+				goprofileStartCPU(f)
+				goprofileCPUFile = f
+			}
+			for _, kind := range goprofileToggleProfiles() {
+				goprofileWrite(kind)
+			}
+			goprofilePeriod = ""
+			goprofileMu.Unlock()
+		}
+	}()
+}
+
+// goprofileToggleProfiles returns the kinds of the profiles written on each
+// toggle signal: heap and goroutine profiles, and all other selected
+// profiles except for the cpu profile.
+func goprofileToggleProfiles() []string {
+	kinds := []string{"heap", "goroutine"}
+	for _, kind := range goprofileProfiles {
+		if kind != "cpu" && kind != "heap" && kind != "goroutine" {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+{{- end}}
+
+{{- if .HTTP}}
+
+const goprofileHTTP = {{printf "%q" .HTTP}}
+
+// goprofileServe serves profiles at goprofileHTTP like net/http/pprof does,
+// under /debug/pprof/. Addresses starting with "unix:" denote Unix domain
+// sockets. The handlers are registered on a private ServeMux; importing
+// net/http/pprof would register them on http.DefaultServeMux. If the address
+// can't be listened on, e.g. because it is in use, the program runs without
+// serving profiles.
+func goprofileServe() {
+	network, addr := "tcp", goprofileHTTP
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		// remove a socket left behind by an earlier run
+		if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		os.Stderr.WriteString("Couldn't serve profiles: " + err.Error() + "\n")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", goprofileServeProfile)
+	mux.HandleFunc("/debug/pprof/cmdline", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+	})
+	mux.HandleFunc("/debug/pprof/profile", func(w http.ResponseWriter, r *http.Request) {
+		goprofileServeTimed(w, r, goprofileStartCPU, pprof.StopCPUProfile)
+	})
+	mux.HandleFunc("/debug/pprof/trace", func(w http.ResponseWriter, r *http.Request) {
+		goprofileServeTimed(w, r, trace.Start, trace.Stop)
+	})
+	go http.Serve(l, mux)
+}
+
+// goprofileServeProfile serves the profile named by the last element of the
+// request path, or an index of all profiles.
+func goprofileServeProfile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	if name == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintln(w, "<html><body><p>Profiles:</p><ul>")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "<li><a href=\"%s?debug=1\">%s</a> (%d)</li>\n", p.Name(), p.Name(), p.Count())
+		}
+		fmt.Fprintln(w, "<li><a href=\"profile?seconds=30\">profile</a> (cpu, 30s)</li>")
+		fmt.Fprintln(w, "<li><a href=\"trace?seconds=1\">trace</a> (1s)</li>")
+		fmt.Fprintln(w, "</ul></body></html>")
+		return
+	}
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.Error(w, "Unknown profile "+name, http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(r.FormValue("debug"))
+	if name == "heap" && r.FormValue("gc") != "" {
+		runtime.GC()
+	}
+	if debug != 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+	}
+	p.WriteTo(w, debug)
+}
+
+// goprofileServeTimed serves a cpu profile or an execution trace covering
+// the number of seconds given in the request (default: 30 and 1).
+func goprofileServeTimed(w http.ResponseWriter, r *http.Request, start func(w io.Writer) error, stop func()) {
+	seconds, err := strconv.ParseFloat(r.FormValue("seconds"), 64)
+	if err != nil || seconds <= 0 {
+		seconds = 30
+		if strings.HasSuffix(r.URL.Path, "/trace") {
+			seconds = 1
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := start(w); err != nil {
+		// e.g. because the cpu profile is written to a file already
+		http.Error(w, "Couldn't start profiling: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-time.After(time.Duration(seconds * float64(time.Second))):
+	case <-r.Context().Done():
+	}
+	stop()
+}
+{{- end}}
+
+// goprofileRecover is deferred by the instrumented main(). It stops all
+// profiles, also if main() panics, in which case it repanics afterwards.
+func goprofileRecover() {
+	if r := recover(); r != nil {
+		goprofileStop()
+		panic(r)
+	}
+	goprofileStop()
+}
+
+// goprofileLabel labels the calling goroutine with the labels of ctx and the
+// label func=name, like pprof.Do does. The returned function restores the
+// labels the goroutine had before, e.g. those of a labeled caller or those
+// set by the program; the instrumented functions defer calling it.
+func goprofileLabel(ctx context.Context, name string) func() {
+	labels := goprofileGetProfLabel()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels("func", name)))
+	return func() {
+		goprofileSetProfLabel(labels)
+	}
+}
+
+// runtime/pprof doesn't let a goroutine read its labels, which the runtime
+// keeps as an opaque pointer. goprofileLabel saves and restores the pointer
+// with the functions runtime/pprof itself uses to access it. They are runtime
+// internals, but the runtime promises to keep them (see go.dev/issue/67401).
+// Verified with Go 1.18, 1.22, 1.23 and 1.27; TestSupportLinknames checks the
+// Go version the tests run with.
+
+//go:linkname goprofileGetProfLabel runtime/pprof.runtime_getProfLabel
+func goprofileGetProfLabel() unsafe.Pointer
+
+//go:linkname goprofileSetProfLabel runtime/pprof.runtime_setProfLabel
+func goprofileSetProfLabel(labels unsafe.Pointer)
+
+// The following functions replace calls to functions that terminate the
+// program without running deferred calls. They behave like the functions
+// they replace, but stop all profiles before exiting. They are passed os.Exit
+// or log.Output as imported by the instrumented file, which keeps the import
+// used.
+
+func goprofileExit(exit func(int), code int) {
+	goprofileStop()
+	exit(code)
+}
+
+func goprofileFatal(output func(int, string) error, v ...interface{}) {
+	output(2, fmt.Sprint(v...))
+	goprofileStop()
+	os.Exit(1)
+}
+
+func goprofileFatalf(output func(int, string) error, format string, v ...interface{}) {
+	output(2, fmt.Sprintf(format, v...))
+	goprofileStop()
+	os.Exit(1)
+}
+
+func goprofileFatalln(output func(int, string) error, v ...interface{}) {
+	output(2, fmt.Sprintln(v...))
+	goprofileStop()
+	os.Exit(1)
+}
+`))
+
+// SupportSource returns the source code of the support file, which declares
+// the identifiers the code injected by an Instrumenter with the same prefix
+// refers to. It has to be added to the instrumented package.
+func SupportSource(config SupportConfig) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := supportTemplate.Execute(&buf, config); err != nil {
+		return nil, err
+	}
+	return hygienic(buf.Bytes(), config.Prefix)
+}
+
+// hygienic makes sure that the support file source src doesn't clash with
+// the declarations of the instrumented package: The identifiers starting
+// with DefaultPrefix get prefix instead, and all packages are imported
+// under names starting with prefix, e.g. goprofile_os. Otherwise, a
+// package-level declaration named like one of the imported packages
+// (e.g. a function named trace) would break the build.
+func hygienic(src []byte, prefix string) ([]byte, error) {
+	fs := token.NewFileSet()
+	file, err := parser.ParseFile(fs, SupportFileName(prefix), src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	ast.Inspect(file, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok && strings.HasPrefix(ident.Name, DefaultPrefix) {
+			ident.Name = prefix + strings.TrimPrefix(ident.Name, DefaultPrefix)
+		}
+		return true
+	})
+	// //go:linkname directives name the declarations they apply to
+	for _, group := range file.Comments {
+		for _, c := range group.List {
+			if strings.HasPrefix(c.Text, "//go:linkname "+DefaultPrefix) {
+				c.Text = "//go:linkname " + prefix + strings.TrimPrefix(c.Text, "//go:linkname "+DefaultPrefix)
+			}
+		}
+	}
+
+	aliases := make(map[string]string)
+	for _, spec := range file.Imports {
+		name := importName(spec)
+		aliases[name] = prefix + "_" + name
+		spec.Name = &ast.Ident{Name: aliases[name], NamePos: spec.Pos()}
+	}
+	ast.Inspect(file, func(node ast.Node) bool {
+		if sel, ok := node.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Obj == nil && aliases[x.Name] != "" {
+				x.Name = aliases[x.Name]
+			}
+		}
+		return true
+	})
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fs, file); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// InitPackageDir returns the name of the directory of the init package,
+// e.g. "_goprofileinit". The leading underscore keeps patterns like
+// "./..." from matching it.
+func InitPackageDir(prefix string) string {
+	return "_" + prefix + "init"
+}
+
+// InitFileName is the name of the only file of the init package.
+const InitFileName = "init.go"
+
+// InitImportFileName returns the name of the file that goprofile adds to the
+// packages imported by the instrumented program to make them import the init
+// package (see InitImportSource), e.g. "goprofile_init.go".
+func InitImportFileName(prefix string) string {
+	return prefix + "_init.go"
+}
+
+var initImportTemplate = template.Must(template.New("initimport").Parse(SupportFileHeader + `
+
+package {{.Name}}
+
+// The cpu profile is started before this package is initialized.
+import _ {{printf "%q" .Init}}
+`))
+
+// InitImportSource returns the source code of the file that makes the package
+// name import the init package with the import path init. Go initializes the
+// packages a package imports before the package itself, whatever their import
+// paths, so the init package has to be imported by every package whose
+// initialization should show up in the profiles.
+func InitImportSource(name, init string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := initImportTemplate.Execute(&buf, struct{ Name, Init string }{name, init}); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+var initTemplate = template.Must(template.New("init").Parse(SupportFileHeader + `
+
+// Package goprofileinit starts the cpu profile and the execution trace
+// before the packages of the instrumented program that import it are
+// initialized, so that their init functions and package-level variables show
+// up in the profiles.
+// As the paths of the profiles are only known once main() runs, the output
+// is buffered until then.
+package goprofileinit
+
+import (
+	"bytes"
+	"io"
+{{- if or .Block .Mutex .CPURate}}
+	"runtime"
+{{- end}}
+{{- if .CPU}}
+	"runtime/pprof"
+{{- end}}
+{{- if .Trace}}
+	"runtime/trace"
+{{- end}}
+	"sync"
+)
+
+// A buffer holds the output of a profile until it is redirected.
+type buffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	w   io.Writer
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.w != nil {
+		return b.w.Write(p)
+	}
+	return b.buf.Write(p)
+}
+
+// buffers holds the buffers of the profiles started by init that haven't
+// been redirected yet, by kind ("cpu" or "trace").
+var buffers = make(map[string]*buffer)
+
+func init() {
+{{- if .Block}}
+	runtime.SetBlockProfileRate(1)
+{{- end}}
+{{- if .Mutex}}
+	runtime.SetMutexProfileFraction(1)
+{{- end}}
+{{- if .CPU}}
+{{- if .CPURate}}
+	runtime.SetCPUProfileRate({{.CPURate}})
+{{- end}}
+	if b := new(buffer); pprof.StartCPUProfile(b) == nil {
+		buffers["cpu"] = b
+	}
+{{- end}}
+{{- if .Trace}}
+	if b := new(buffer); trace.Start(b) == nil {
+		buffers["trace"] = b
+	}
+{{- end}}
+}
+
+// Redirect writes the output of the profile of the given kind buffered so far
+// to w, and makes the profile write to w directly from now on. It returns false
+// if the profile wasn't started by init or has been redirected already.
+func Redirect(kind string, w io.Writer) bool {
+	b := buffers[kind]
+	if b == nil {
+		return false
+	}
+	delete(buffers, kind)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.WriteTo(w)
+	b.w = w
+	return true
+}
+`))
+
+// InitSource returns the source code of the init package, which starts the
+// cpu profile and the execution trace before the packages of the program that
+// import it are initialized. The support file imports it if config.Init is set.
+func InitSource(config SupportConfig) ([]byte, error) {
+	data := struct {
+		CPU, Block, Mutex, Trace bool
+		CPURate                  int
+	}{Trace: config.Trace, CPURate: config.CPURate}
+	for _, kind := range config.Profiles {
+		switch kind {
+		case "cpu":
+			data.CPU = true
+		case "block":
+			data.Block = true
+		case "mutex":
+			data.Mutex = true
+		}
+	}
+	if !data.CPU {
+		data.CPURate = 0
+	}
+	var buf bytes.Buffer
+	if err := initTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
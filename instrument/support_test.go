@@ -0,0 +1,234 @@
+package instrument
+
+import (
+	"bytes"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSupportSourceQuoting(t *testing.T) {
+	t.Parallel()
+	proffile := "foo\" \"asd.out"
+	src, err := SupportSource(SupportConfig{
+		Prefix:   DefaultPrefix,
+		ProfFile: proffile,
+		Profiles: []string{"cpu", "heap"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), SupportFileName(DefaultPrefix), src, 0)
+	if err != nil {
+		t.Fatalf("Support file doesn't parse: %s\n%s", err, src)
+	}
+	if file.Name.Name != "main" {
+		t.Fatalf("Expected package main, got %s", file.Name.Name)
+	}
+	for _, expected := range []string{
+		"const goprofileOut = " + strconv.Quote(proffile),
+		`var goprofileProfiles = []string{"cpu", "heap"}`,
+	} {
+		if !strings.Contains(string(src), expected) {
+			t.Fatalf("Expected support file to contain %s\n%s", expected, src)
+		}
+	}
+}
+
+func TestSupportSourcePrefix(t *testing.T) {
+	t.Parallel()
+	src, err := SupportSource(SupportConfig{
+		Prefix:   "goprofile2",
+		ProfFile: "out.pprof",
+		Profiles: []string{"cpu"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), SupportFileName("goprofile2"), src, 0)
+	if err != nil {
+		t.Fatalf("Support file doesn't parse: %s\n%s", err, src)
+	}
+	for _, spec := range file.Imports {
+		if spec.Name == nil || !strings.HasPrefix(spec.Name.Name, "goprofile2_") {
+			t.Fatalf("Expected import %s to have a name starting with goprofile2_\n%s", spec.Path.Value, src)
+		}
+	}
+	for _, decl := range file.Scope.Objects {
+		if !strings.HasPrefix(decl.Name, "goprofile2") {
+			t.Fatalf("Expected %s to start with goprofile2\n%s", decl.Name, src)
+		}
+	}
+	for _, expected := range []string{
+		"func goprofile2Start() bool {",
+		"goprofile2_pprof.StartCPUProfile(w)",
+		"//go:linkname goprofile2GetProfLabel runtime/pprof.runtime_getProfLabel",
+	} {
+		if !strings.Contains(string(src), expected) {
+			t.Fatalf("Expected support file to contain %s\n%s", expected, src)
+		}
+	}
+}
+
+func TestSupportSourceHTTP(t *testing.T) {
+	t.Parallel()
+	for _, addr := range []string{"", "localhost:6060"} {
+		src, err := SupportSource(SupportConfig{
+			Prefix:   DefaultPrefix,
+			ProfFile: "out.pprof",
+			HTTP:     addr,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parser.ParseFile(token.NewFileSet(), SupportFileName(DefaultPrefix), src, 0); err != nil {
+			t.Fatalf("Support file doesn't parse: %s\n%s", err, src)
+		}
+		// Only binaries serving profiles should depend on net/http.
+		if served := strings.Contains(string(src), `goprofile_http "net/http"`); served != (addr != "") {
+			t.Fatalf("Expected net/http import to be present: %v\n%s", addr != "", src)
+		}
+	}
+}
+
+func TestInitSource(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		config  SupportConfig
+		imports []string
+	}{
+		{SupportConfig{Profiles: []string{"cpu"}}, []string{"runtime/pprof"}},
+		{SupportConfig{Profiles: []string{"cpu"}, CPURate: 500}, []string{"runtime", "runtime/pprof"}},
+		{SupportConfig{Profiles: []string{"heap", "mutex"}, CPURate: 500}, []string{"runtime"}},
+		{SupportConfig{Trace: true}, []string{"runtime/trace"}},
+	} {
+		src, err := InitSource(test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), InitFileName, src, parser.ImportsOnly)
+		if err != nil {
+			t.Fatalf("Init package doesn't parse: %s\n%s", err, src)
+		}
+		// Unused imports would break the build.
+		var imports []string
+		for _, spec := range file.Imports {
+			if path, _ := strconv.Unquote(spec.Path.Value); strings.HasPrefix(path, "runtime") {
+				imports = append(imports, path)
+			}
+		}
+		if strings.Join(imports, ",") != strings.Join(test.imports, ",") {
+			t.Fatalf("Expected imports %v, got %v\n%s", test.imports, imports, src)
+		}
+	}
+
+	src, err := SupportSource(SupportConfig{
+		Prefix:   "goprofile2",
+		ProfFile: "out.pprof",
+		Init:     "example.com/m/_goprofile2init",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(src), `goprofile2_goprofile2init "example.com/m/_goprofile2init"`) ||
+		!strings.Contains(string(src), "goprofile2_goprofile2init.Redirect(kind, f)") {
+		t.Fatalf("Expected the init package to be imported hygienically\n%s", src)
+	}
+
+	src, err = InitImportSource("zlib", "example.com/m/_goprofileinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), InitImportFileName(DefaultPrefix), src, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Import of the init package doesn't parse: %s\n%s", err, src)
+	}
+	if !IsGenerated(file) || file.Name.Name != "zlib" || len(file.Imports) != 1 ||
+		file.Imports[0].Name.Name != "_" || file.Imports[0].Path.Value != `"example.com/m/_goprofileinit"` {
+		t.Fatalf("Expected a generated file of package zlib importing the init package\n%s", src)
+	}
+}
+
+// linknames returns the functions declared in file that are linked to another
+// package's functions by //go:linkname, mapped from the name they are linked
+// to (e.g. "runtime/pprof.runtime_getProfLabel") to their signatures.
+func linknames(fset *token.FileSet, file *ast.File) map[string]string {
+	funcs := make(map[string]string)
+	for _, decl := range file.Decls {
+		fun, ok := decl.(*ast.FuncDecl)
+		if !ok || fun.Doc == nil {
+			continue
+		}
+		for _, c := range fun.Doc.List {
+			fields := strings.Fields(c.Text)
+			if len(fields) == 3 && fields[0] == "//go:linkname" && fields[1] == fun.Name.Name {
+				// without the parameter names
+				var params []string
+				for _, field := range fun.Type.Params.List {
+					var buf bytes.Buffer
+					printer.Fprint(&buf, fset, field.Type)
+					for i := 0; i < len(field.Names) || i == 0; i++ {
+						params = append(params, buf.String())
+					}
+				}
+				var buf bytes.Buffer
+				if fun.Type.Results != nil {
+					printer.Fprint(&buf, fset, fun.Type.Results.List[0].Type)
+				}
+				funcs[fields[2]] = strings.TrimSpace("func(" + strings.Join(params, ", ") + ") " + buf.String())
+			}
+		}
+	}
+	return funcs
+}
+
+// The support file reads and restores the labels of a goroutine with
+// functions the runtime provides to runtime/pprof. This test fails if the
+// runtime doesn't provide them anymore, rather than the build of every
+// program instrumented with -label.
+func TestSupportLinknames(t *testing.T) {
+	t.Parallel()
+	src, err := SupportSource(SupportConfig{Prefix: DefaultPrefix, Profiles: []string{"cpu"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pulled := linknames(fset, file)
+	if len(pulled) == 0 {
+		t.Fatal("Expected the support file to link to runtime functions")
+	}
+
+	pkg, err := build.Import("runtime", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provided := make(map[string]string)
+	for _, name := range pkg.GoFiles {
+		file, err := parser.ParseFile(fset, filepath.Join(pkg.Dir, name), nil, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, signature := range linknames(fset, file) {
+			provided[name] = signature
+		}
+	}
+	for name, signature := range pulled {
+		// The support file imports unsafe as goprofile_unsafe.
+		signature = strings.Replace(signature, DefaultPrefix+"_", "", -1)
+		if provided[name] != signature {
+			t.Errorf("The support file links to %s %s, which the runtime of %s doesn't provide (found %q)",
+				name, signature, runtime.Version(), provided[name])
+		}
+	}
+}
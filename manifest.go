@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// manifestName is the name of the manifest goprofile writes to the directory
+// of a package it instruments in-place. It starts with a dot, so that the go
+// command ignores it.
+const manifestName = ".goprofile.json"
+
+// A manifest records the changes goprofile made to a package when
+// instrumenting it in-place, so that 'goprofile revert' can undo them.
+// It is saved after every change, so that it is complete even if the
+// instrumentation fails halfway.
+type manifest struct {
+	// dir is the directory the manifest is saved to. The paths of
+	// the entries are relative to it.
+	dir     string
+	Entries []*manifestEntry
+}
+
+// A manifestEntry records a file modified or created by goprofile, or a
+// directory created by goprofile.
+type manifestEntry struct {
+	Path string
+	// Original holds the contents of a modified file before goprofile
+	// first instrumented it, including edits made before instrumenting it
+	// again (see modify). It is nil for created files and directories.
+	Original []byte `json:",omitempty"`
+	Created  bool   `json:",omitempty"`
+	Dir      bool   `json:",omitempty"`
+	// Hash is the SHA-256 hash of the contents goprofile wrote last.
+	Hash string `json:",omitempty"`
+}
+
+func hashContents(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadManifest loads the manifest in dir. If there is none, it returns an
+// empty manifest that is saved to dir.
+func loadManifest(dir string) (*manifest, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{dir: dir}
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %s", filepath.Join(dir, manifestName), err)
+	}
+	return m, nil
+}
+
+// save writes the manifest to its directory.
+func (m *manifest) save() error {
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(m.dir, manifestName), data, 0644); err != nil {
+		return fmt.Errorf("Failed to write manifest: %s", err)
+	}
+	return nil
+}
+
+// entry returns the entry for path, adding a new one if there is none.
+// The entries of files instrumented again keep their original contents.
+func (m *manifest) entry(path string) (*manifestEntry, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(m.dir, abs)
+	if err != nil {
+		return nil, err
+	}
+	rel = filepath.ToSlash(rel)
+	for _, e := range m.Entries {
+		if e.Path == rel {
+			return e, nil
+		}
+	}
+	e := &manifestEntry{Path: rel}
+	m.Entries = append(m.Entries, e)
+	return e, nil
+}
+
+// modify records that the file at path with the contents current is about
+// to be overwritten with the contents instrumented. If goprofile wrote the
+// file before and it was edited since, the edits are kept: The original
+// contents become the current ones with the instrumentation stripped.
+func (m *manifest) modify(path string, current, instrumented []byte) error {
+	e, err := m.entry(path)
+	if err != nil {
+		return err
+	}
+	if e.Hash == "" && !e.Created {
+		e.Original = current
+	} else if !e.Created && hashContents(current) != e.Hash {
+		if e.Original, _, err = stripSource(path, current); err != nil {
+			return err
+		}
+	}
+	e.Hash = hashContents(instrumented)
+	return m.save()
+}
+
+// create records that goprofile created the file at path.
+func (m *manifest) create(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	e, err := m.entry(path)
+	if err != nil {
+		return err
+	}
+	if e.Hash == "" {
+		e.Created = true
+	}
+	e.Hash = hashContents(contents)
+	return m.save()
+}
+
+// createDir records that the directory at path was created.
+func (m *manifest) createDir(path string) error {
+	e, err := m.entry(path)
+	if err != nil {
+		return err
+	}
+	e.Dir = true
+	return m.save()
+}
+
+// revertDir returns the directory containing the manifest of the package given
+// to 'goprofile revert': the current directory if args is empty, otherwise the
+// given directory, the directory of the given file, or the directory of the
+// given package.
+func revertDir(args []string) (string, error) {
+	switch len(args) {
+	case 0:
+		return ".", nil
+	case 1:
+		if fi, err := os.Stat(args[0]); err == nil {
+			if fi.IsDir() {
+				return args[0], nil
+			}
+			return filepath.Dir(args[0]), nil
+		}
+		pkg, err := listPackage(args[0])
+		if err != nil {
+			return "", err
+		}
+		return pkg.Dir, nil
+	default:
+		return "", errors.New("usage: goprofile revert [package | directory]")
+	}
+}
+
+// revert implements 'goprofile revert', which undoes the in-place
+// instrumentation recorded in a manifest. If any file was edited after
+// goprofile wrote it, revert prints a diff of the changes reverting would
+// discard and doesn't change anything.
+func revert(args []string) error {
+	dir, err := revertDir(args)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, manifestName)); os.IsNotExist(err) {
+		return fmt.Errorf("No %s in %s; nothing to revert", manifestName, dir)
+	}
+	m, err := loadManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	var edited []string
+	for _, e := range m.Entries {
+		if e.Dir {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(e.Path))
+		contents, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) && e.Created {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if hashContents(contents) == e.Hash || !e.Created && string(contents) == string(e.Original) {
+			continue
+		}
+		edited = append(edited, path)
+		os.Stderr.Write(unifiedDiff(path, path+" (reverted)", contents, e.Original))
+	}
+	if len(edited) > 0 {
+		return fmt.Errorf("Not reverting: %s changed after instrumentation (see the diff above)",
+			strings.Join(edited, ", "))
+	}
+
+	for _, e := range m.Entries {
+		path := filepath.Join(dir, filepath.FromSlash(e.Path))
+		if e.Created && !e.Dir {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		} else if !e.Dir {
+			if err := overwriteFile(path, e.Original); err != nil {
+				return err
+			}
+		}
+		if options.Verbose {
+			fmt.Fprintln(os.Stderr, "Reverted", path)
+		}
+	}
+	// directories last, as they have to be empty
+	for _, e := range m.Entries {
+		if e.Dir {
+			os.Remove(filepath.Join(dir, filepath.FromSlash(e.Path)))
+		}
+	}
+	return os.Remove(filepath.Join(dir, manifestName))
+}
+
+// overwriteFile replaces the contents of the existing file at path,
+// keeping its permissions.
+func overwriteFile(path string, contents []byte) error {
+	f, err := os.OpenFile(path, os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("Failed to truncate file: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(contents); err != nil {
+		return fmt.Errorf("Failed to write %s: %s", path, err)
+	}
+	return nil
+}
@@ -1,80 +1,165 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"go/ast"
+	"go/format"
 	"go/parser"
-	"go/printer"
 	"go/token"
+	"io/ioutil"
 	"os"
 	"strings"
+
+	"github.com/lorenzb/goprofile/instrument"
 )
 
-func processGoFile(from, to string) (foundMain bool, err error) {
-	var fileAst *ast.File
-	fs := token.NewFileSet()
-	fileAst, err = parser.ParseFile(fs, from, nil, parser.ParseComments)
+// instrumentFiles instruments the given files of a main package (see
+// instrument.Instrumenter.Files) according to the command line options.
+// Warnings are printed, and so are the notes of -v.
+func instrumentFiles(paths []string) (*instrument.Package, error) {
+	in := instrument.New(instrument.Options{
+		Label:   options.Label,
+		Context: buildContext(),
+		// The copies in the work directory and the overlay get //line
+		// directives; files changed in-place and diffs should look
+		// like the originals.
+		LineDirectives: !options.InPlace && !options.DryRun,
+	})
+	pkg, err := in.Files(paths)
 	if err != nil {
-		return false, fmt.Errorf("Parser error: %s", err)
+		return nil, err
 	}
-
-	if hasMain(fileAst) {
-		instrument(fileAst, options.ProfFile)
-
-		outFile, err := os.OpenFile(to, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
-		if err != nil {
-			return true, fmt.Errorf("Failed to create file: %s", err)
+	for _, f := range pkg.Files {
+		for _, warning := range f.Warnings {
+			fmt.Fprintln(os.Stderr, "Warning:", warning)
+		}
+		if f.Stripped && options.Verbose {
+			fmt.Fprintf(os.Stderr, "Replacing the code injected into %s by an earlier run of goprofile.\n", f.Path)
 		}
-		defer outFile.Close()
-
-		printer.Fprint(outFile, fs, fileAst)
-
-		return true, nil
-	} else {
-		return false, duplicateFile(from, to)
 	}
+	return pkg, nil
 }
 
-func processFile(from, to string) (foundMain bool, err error) {
-	if strings.HasSuffix(from, ".go") {
-		foundMain, err := processGoFile(from, to)
-		if err != nil {
-			return foundMain, fmt.Errorf("Error processing go file %s: %s", from, err)
-		}
-		return foundMain, nil
-	} else {
-		if err = duplicateFile(from, to); err != nil {
-			return false, fmt.Errorf("Error duplicating file %s: %s", from, err)
+// processFile writes the instrumented file f to the path to. Files that
+// weren't changed by the instrumentation, including files that aren't go
+// files (f is nil then), are duplicated from the path from instead.
+func processFile(from, to string, f *instrument.File) error {
+	if f != nil && f.Changed() {
+		if err := writeInstrumented(f, to); err != nil {
+			return fmt.Errorf("Error processing go file %s: %s", from, err)
 		}
-		return false, nil
+		return nil
+	}
+	if err := duplicateFile(from, to); err != nil {
+		return fmt.Errorf("Error duplicating file %s: %s", from, err)
+	}
+	return nil
+}
+
+// processFileInPlace overwrites the original of the instrumented file f if it
+// was changed by the instrumentation. The original contents are recorded in
+// the manifest m before the file is overwritten.
+func processFileInPlace(f *instrument.File, m *manifest) error {
+	if !f.Changed() {
+		return nil
 	}
+	original, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	if err := m.modify(f.Path, original, f.Source); err != nil {
+		return err
+	}
+	return overwriteFile(f.Path, f.Source)
 }
 
-func processFileInPlace(path string) (foundMain bool, err error) {
-	if !strings.HasSuffix(path, ".go") {
+// processFileOverlay is like processFile, but only writes files that were
+// changed by the instrumentation. Other files are left alone, because the
+// build uses them from their original location. changed reports whether a
+// file was written.
+func processFileOverlay(to string, f *instrument.File) (changed bool, err error) {
+	if !f.Changed() {
 		return false, nil
 	}
+	if err := writeInstrumented(f, to); err != nil {
+		return false, fmt.Errorf("Error processing go file %s: %s", f.Path, err)
+	}
+	return true, nil
+}
 
-	var fileAst *ast.File
-	fs := token.NewFileSet()
-	fileAst, err = parser.ParseFile(fs, path, nil, parser.ParseComments)
+// writeInstrumented writes the source of the instrumented file f to the
+// new file at path to.
+func writeInstrumented(f *instrument.File, to string) error {
+	outFile, err := os.OpenFile(to, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
 	if err != nil {
-		return false, fmt.Errorf("Parser error: %s", err)
+		return fmt.Errorf("Failed to create file: %s", err)
+	}
+	defer outFile.Close()
+	if _, err := outFile.Write(f.Source); err != nil {
+		return fmt.Errorf("Failed to write %s: %s", to, err)
 	}
+	return nil
+}
 
-	if hasMain(fileAst) {
-		instrument(fileAst, options.ProfFile)
+// writeOverlay writes a file for the -overlay flag of 'go build'.
+// replace maps the paths of files in the source tree to
+// the paths of the files replacing them.
+func writeOverlay(path string, replace map[string]string) error {
+	data, err := json.MarshalIndent(struct{ Replace map[string]string }{replace}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
 
-		outFile, err := os.OpenFile(path, os.O_TRUNC|os.O_WRONLY, 0666)
+// generatedFiles returns those of the given paths that are go files
+// generated by goprofile (see instrument.IsGenerated).
+func generatedFiles(paths []string) ([]string, error) {
+	var generated []string
+	for _, p := range paths {
+		if !strings.HasSuffix(p, ".go") {
+			continue
+		}
+		fileAst, err := parser.ParseFile(token.NewFileSet(), p, nil, parser.PackageClauseOnly|parser.ParseComments)
 		if err != nil {
-			return true, fmt.Errorf("Failed to truncate file: %s", err)
+			return nil, fmt.Errorf("Parser error: %s", err)
+		}
+		if instrument.IsGenerated(fileAst) {
+			generated = append(generated, p)
 		}
-		defer outFile.Close()
+	}
+	return generated, nil
+}
 
-		printer.Fprint(outFile, fs, fileAst)
+// stripFile removes the code injected by goprofile from the go file at path
+// (see instrument.Strip), and reports whether the file changed.
+func stripFile(path string) (bool, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	stripped, changed, err := stripSource(path, src)
+	if err != nil || !changed {
+		return false, err
+	}
+	return true, overwriteFile(path, stripped)
+}
 
-		return true, nil
-	} else {
-		return false, nil
+// stripSource removes the code injected by goprofile from src, the contents
+// of the go file at path, and reports whether it changed.
+func stripSource(path string, src []byte) ([]byte, bool, error) {
+	fs := token.NewFileSet()
+	fileAst, err := parser.ParseFile(fs, path, src, parser.ParseComments)
+	if err != nil {
+		return nil, false, fmt.Errorf("Parser error: %s", err)
+	}
+	if !instrument.Strip(fs, fileAst) {
+		return src, false, nil
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fs, fileAst); err != nil {
+		return nil, false, err
 	}
+	return buf.Bytes(), true, nil
 }
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"debug/elf"
+	"debug/gosym"
+	"debug/macho"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+	"github.com/lorenzb/goprofile/instrument"
+)
+
+// A reportEntry accumulates the samples attributed to a function.
+type reportEntry struct {
+	name string
+	// flat is the sum of the samples in which the function is the leaf,
+	// cum the sum of the samples in which it appears anywhere in the stack.
+	flat, cum int64
+}
+
+// isGoprofileFrame determines whether a stack frame belongs to the
+// support file added by goprofile.
+func isGoprofileFrame(line profile.Line) bool {
+	if line.Function == nil {
+		return false
+	}
+	base := filepath.Base(line.Function.Filename)
+	return strings.HasPrefix(line.Function.Name, "main."+instrument.DefaultPrefix) ||
+		strings.HasPrefix(base, instrument.DefaultPrefix) && strings.HasSuffix(base, instrument.SupportFileSuffix)
+}
+
+// frameNames returns the names of the functions on the stack of a sample,
+// starting with the leaf. Inlined functions get frames of their own.
+func frameNames(sample *profile.Sample, hideGoprofile bool) []string {
+	var names []string
+	for _, loc := range sample.Location {
+		if len(loc.Line) == 0 {
+			names = append(names, fmt.Sprintf("0x%x", loc.Address))
+			continue
+		}
+		for _, line := range loc.Line {
+			if hideGoprofile && isGoprofileFrame(line) {
+				continue
+			}
+			if line.Function == nil {
+				names = append(names, fmt.Sprintf("0x%x", loc.Address))
+			} else {
+				names = append(names, line.Function.Name)
+			}
+		}
+	}
+	return names
+}
+
+// sampleIndex returns the index of the sample value with the given type.
+// If sampleType is empty, it returns the index of the profile's default
+// sample type.
+func sampleIndex(prof *profile.Profile, sampleType string) (int, error) {
+	if sampleType == "" {
+		sampleType = prof.DefaultSampleType
+	}
+	if sampleType == "" {
+		return len(prof.SampleType) - 1, nil
+	}
+	var types []string
+	for i, st := range prof.SampleType {
+		if st.Type == sampleType {
+			return i, nil
+		}
+		types = append(types, st.Type)
+	}
+	return 0, fmt.Errorf("profile has no sample type '%s' (available: %s)", sampleType, strings.Join(types, ", "))
+}
+
+// matchesAny determines whether any of the names matches re.
+func matchesAny(re *regexp.Regexp, names []string) bool {
+	for _, name := range names {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregate computes a report entry for every function in the profile,
+// considering only the samples passing the focus and ignore filters
+// given on the command line.
+func aggregate(prof *profile.Profile, index int) (entries []*reportEntry, total int64, err error) {
+	var focus, ignore *regexp.Regexp
+	if options.Focus != "" {
+		if focus, err = regexp.Compile(options.Focus); err != nil {
+			return nil, 0, fmt.Errorf("invalid focus regexp: %s", err)
+		}
+	}
+	if options.Ignore != "" {
+		if ignore, err = regexp.Compile(options.Ignore); err != nil {
+			return nil, 0, fmt.Errorf("invalid ignore regexp: %s", err)
+		}
+	}
+
+	byName := make(map[string]*reportEntry)
+	entry := func(name string) *reportEntry {
+		e, ok := byName[name]
+		if !ok {
+			e = &reportEntry{name: name}
+			byName[name] = e
+			entries = append(entries, e)
+		}
+		return e
+	}
+
+	for _, sample := range prof.Sample {
+		names := frameNames(sample, options.HideGoprofile)
+		if len(names) == 0 ||
+			focus != nil && !matchesAny(focus, names) ||
+			ignore != nil && matchesAny(ignore, names) {
+			continue
+		}
+		value := sample.Value[index]
+		total += value
+		entry(names[0]).flat += value
+		seen := make(map[string]bool)
+		for _, name := range names {
+			if !seen[name] {
+				entry(name).cum += value
+				seen[name] = true
+			}
+		}
+	}
+	return entries, total, nil
+}
+
+// A unitScale is a unit used for displaying values, e.g. "ms" for 1e6 nanoseconds.
+type unitScale struct {
+	factor float64
+	suffix string
+}
+
+var unitScales = map[string][]unitScale{
+	"nanoseconds": {{1e9, "s"}, {1e6, "ms"}, {1e3, "us"}},
+	"bytes":       {{1 << 30, "GB"}, {1 << 20, "MB"}, {1 << 10, "kB"}},
+}
+
+var unitSuffixes = map[string]string{
+	"nanoseconds": "ns",
+	"bytes":       "B",
+}
+
+// formatValue formats a sample value of the given unit for humans.
+func formatValue(value int64, unit string) string {
+	if value == 0 {
+		return "0"
+	}
+	abs := float64(value)
+	if abs < 0 {
+		abs = -abs
+	}
+	for _, scale := range unitScales[unit] {
+		if abs >= scale.factor {
+			return fmt.Sprintf("%.2f%s", float64(value)/scale.factor, scale.suffix)
+		}
+	}
+	return fmt.Sprintf("%d%s", value, unitSuffixes[unit])
+}
+
+func percent(value, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(value) / float64(total)
+}
+
+// writeTable writes the first options.Top entries as a table like the
+// one printed by 'go tool pprof -top'.
+func writeTable(w io.Writer, entries []*reportEntry, total int64, unit string) {
+	fmt.Fprintf(w, "%10s %6s %6s %10s %6s\n", "flat", "flat%", "sum%", "cum", "cum%")
+	var sum int64
+	for i, e := range entries {
+		if i == options.Top {
+			break
+		}
+		sum += e.flat
+		fmt.Fprintf(w, "%10s %5.2f%% %5.2f%% %10s %5.2f%%  %s\n",
+			formatValue(e.flat, unit), percent(e.flat, total), percent(sum, total),
+			formatValue(e.cum, unit), percent(e.cum, total), e.name)
+	}
+}
+
+// writeReport writes the top functions of the profile by flat and by
+// cumulative value to w.
+func writeReport(w io.Writer, prof *profile.Profile) error {
+	index, err := sampleIndex(prof, options.SampleType)
+	if err != nil {
+		return err
+	}
+	entries, total, err := aggregate(prof, index)
+	if err != nil {
+		return err
+	}
+	sampleType := prof.SampleType[index]
+
+	n := options.Top
+	if n > len(entries) {
+		n = len(entries)
+	}
+	fmt.Fprintf(w, "Type: %s\n", sampleType.Type)
+	fmt.Fprintf(w, "Total: %s\n", formatValue(total, sampleType.Unit))
+
+	// sort by name first to get a deterministic order for equal values
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].flat > entries[j].flat })
+	fmt.Fprintf(w, "\nShowing top %d of %d functions by flat %s\n", n, len(entries), sampleType.Type)
+	writeTable(w, entries, total, sampleType.Unit)
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].cum > entries[j].cum })
+	fmt.Fprintf(w, "\nShowing top %d of %d functions by cumulative %s\n", n, len(entries), sampleType.Type)
+	writeTable(w, entries, total, sampleType.Unit)
+	return nil
+}
+
+// reportFile writes a report for the profile at path. If binary isn't
+// empty, it is used to symbolize the profile if necessary.
+func reportFile(w io.Writer, path, binary string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	prof, err := profile.Parse(f)
+	if err != nil {
+		return fmt.Errorf("Failed to parse profile %s: %s", path, err)
+	}
+	if binary != "" {
+		if err := symbolize(prof, binary); err != nil {
+			return fmt.Errorf("Failed to symbolize profile: %s", err)
+		}
+	}
+	return writeReport(w, prof)
+}
+
+// symbolize adds function and line information to the locations of the
+// profile that lack it, using the symbol table of the given Go binary.
+// Profiles written by Go 1.9 and newer are symbolized already.
+func symbolize(prof *profile.Profile, binary string) error {
+	var missing bool
+	for _, loc := range prof.Location {
+		if len(loc.Line) == 0 {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	table, base, err := loadSymbols(binary)
+	if err != nil {
+		return err
+	}
+
+	functions := make(map[string]*profile.Function)
+	for _, loc := range prof.Location {
+		if len(loc.Line) != 0 {
+			continue
+		}
+		addr := loc.Address
+		if loc.Mapping != nil && base != nil {
+			addr = base(loc.Mapping, addr)
+		}
+		file, line, fn := table.PCToLine(addr)
+		if fn == nil {
+			continue
+		}
+		f, ok := functions[fn.Name]
+		if !ok {
+			f = &profile.Function{
+				ID:       uint64(len(prof.Function) + 1),
+				Name:     fn.Name,
+				Filename: file,
+			}
+			prof.Function = append(prof.Function, f)
+			functions[fn.Name] = f
+		}
+		loc.Line = []profile.Line{{Function: f, Line: int64(line)}}
+	}
+	return nil
+}
+
+// loadSymbols reads the Go symbol table of the binary. If the binary is
+// position independent, base translates addresses in a mapping of the
+// binary to addresses in the symbol table.
+func loadSymbols(binary string) (table *gosym.Table, base func(*profile.Mapping, uint64) uint64, err error) {
+	var pclntab []byte
+	var text uint64
+
+	if f, err := elf.Open(binary); err == nil {
+		defer f.Close()
+		pcln, txt := f.Section(".gopclntab"), f.Section(".text")
+		if pcln == nil || txt == nil {
+			return nil, nil, errors.New("no Go symbol table found")
+		}
+		if pclntab, err = pcln.Data(); err != nil {
+			return nil, nil, err
+		}
+		text = txt.Addr
+		if f.Type == elf.ET_DYN {
+			for _, prog := range f.Progs {
+				if prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_X != 0 {
+					vaddr, off := prog.Vaddr, prog.Off
+					base = func(m *profile.Mapping, addr uint64) uint64 {
+						return addr - m.Start + m.Offset + vaddr - off
+					}
+					break
+				}
+			}
+		}
+	} else if f, err := macho.Open(binary); err == nil {
+		defer f.Close()
+		pcln, txt := f.Section("__gopclntab"), f.Section("__text")
+		if pcln == nil || txt == nil {
+			return nil, nil, errors.New("no Go symbol table found")
+		}
+		if pclntab, err = pcln.Data(); err != nil {
+			return nil, nil, err
+		}
+		text = txt.Addr
+	} else {
+		return nil, nil, errors.New("unsupported binary format (only ELF and Mach-O are supported)")
+	}
+
+	table, err = gosym.NewTable(nil, gosym.NewLineTable(pclntab, text))
+	if err != nil {
+		return nil, nil, err
+	}
+	return table, base, nil
+}
+
+// report implements 'goprofile report <profile> [binary]'.
+func report(args []string) error {
+	switch len(args) {
+	case 1:
+		return reportFile(os.Stdout, args[0], "")
+	case 2:
+		return reportFile(os.Stdout, args[0], args[1])
+	default:
+		return errors.New("usage: goprofile report [flags] <profile> [binary]")
+	}
+}
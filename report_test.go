@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+// newTestProfile returns a cpu profile with the following samples:
+//
+//	30ms main.main -> main.work -> main.hot
+//	20ms main.main -> main.work
+//	10ms main.main -> main.goprofileFlush -> runtime.GC
+func newTestProfile() *profile.Profile {
+	var id uint64
+	locs := make(map[string]*profile.Location)
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+	}
+	stack := func(names ...string) []*profile.Location {
+		var stack []*profile.Location
+		for i := len(names) - 1; i >= 0; i-- {
+			loc, ok := locs[names[i]]
+			if !ok {
+				id++
+				fn := &profile.Function{ID: id, Name: names[i], Filename: "main.go"}
+				loc = &profile.Location{ID: id, Address: id, Line: []profile.Line{{Function: fn, Line: 1}}}
+				p.Function = append(p.Function, fn)
+				p.Location = append(p.Location, loc)
+				locs[names[i]] = loc
+			}
+			stack = append(stack, loc)
+		}
+		return stack
+	}
+	p.Sample = []*profile.Sample{
+		{Value: []int64{3, 30e6}, Location: stack("main.main", "main.work", "main.hot")},
+		{Value: []int64{2, 20e6}, Location: stack("main.main", "main.work")},
+		{Value: []int64{1, 10e6}, Location: stack("main.main", "main.goprofileFlush", "runtime.GC")},
+	}
+	return p
+}
+
+func testReport(t *testing.T, focus, ignore string, hide bool, expected ...string) {
+	options.Top = 10
+	options.Focus = focus
+	options.Ignore = ignore
+	options.HideGoprofile = hide
+	options.SampleType = ""
+
+	buf := &bytes.Buffer{}
+	if err := writeReport(buf, newTestProfile()); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range expected {
+		if !strings.Contains(buf.String(), e) {
+			t.Fatalf("Expected report to contain %#v\n%s", e, buf.String())
+		}
+	}
+}
+
+// The report tests modify options and thus don't run in parallel.
+
+func TestReport(t *testing.T) {
+	testReport(t, "", "", false,
+		"Type: cpu\nTotal: 60.00ms\n",
+		"Showing top 5 of 5 functions by flat cpu\n"+
+			"      flat  flat%   sum%        cum   cum%\n"+
+			"   30.00ms 50.00% 50.00%    30.00ms 50.00%  main.hot\n"+
+			"   20.00ms 33.33% 83.33%    50.00ms 83.33%  main.work\n"+
+			"   10.00ms 16.67% 100.00%    10.00ms 16.67%  runtime.GC\n"+
+			"         0  0.00% 100.00%    10.00ms 16.67%  main.goprofileFlush\n"+
+			"         0  0.00% 100.00%    60.00ms 100.00%  main.main\n",
+		"Showing top 5 of 5 functions by cumulative cpu\n"+
+			"      flat  flat%   sum%        cum   cum%\n"+
+			"         0  0.00%  0.00%    60.00ms 100.00%  main.main\n"+
+			"   20.00ms 33.33% 33.33%    50.00ms 83.33%  main.work\n",
+	)
+}
+
+func TestReportHideGoprofile(t *testing.T) {
+	testReport(t, "", "", true,
+		"Showing top 4 of 4 functions by flat cpu\n",
+		"   10.00ms 16.67% 100.00%    10.00ms 16.67%  runtime.GC\n",
+	)
+}
+
+func TestReportFocusIgnore(t *testing.T) {
+	testReport(t, "work", "", false,
+		"Total: 50.00ms\n",
+		"   30.00ms 60.00% 60.00%    30.00ms 60.00%  main.hot\n",
+	)
+	testReport(t, "", "hot|GC", false,
+		"Total: 20.00ms\n",
+		"   20.00ms 100.00% 100.00%    20.00ms 100.00%  main.work\n",
+	)
+}
+
+func TestFormatValue(t *testing.T) {
+	for _, test := range []struct {
+		value    int64
+		unit     string
+		expected string
+	}{
+		{1500000000, "nanoseconds", "1.50s"},
+		{999, "nanoseconds", "999ns"},
+		{0, "nanoseconds", "0"},
+		{3 << 20, "bytes", "3.00MB"},
+		{-2048, "bytes", "-2.00kB"},
+		{42, "count", "42"},
+	} {
+		if actual := formatValue(test.value, test.unit); actual != test.expected {
+			t.Fatalf("formatValue(%d, %s): expected %s, got %s", test.value, test.unit, test.expected, actual)
+		}
+	}
+}
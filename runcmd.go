@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// programExit is returned by run if the program run by 'goprofile run'
+// exits with a non-zero exit code. main exits with the same exit code.
+type programExit struct {
+	code int
+}
+
+func (e programExit) Error() string {
+	return fmt.Sprintf("program exited with exit code %d", e.code)
+}
+
+// runProgram runs the instrumented binary with the arguments given
+// after "--", passing through stdin, stdout and stderr. Afterwards,
+// it prints a summary of the collected profile. proffile is the
+// profile path baked into the binary.
+func runProgram(binary, proffile string) error {
+	program := exec.Command(binary, options.RunArgs...)
+	program.Stdin = os.Stdin
+	program.Stdout = os.Stdout
+	program.Stderr = os.Stderr
+
+	if options.Verbose {
+		fmt.Fprintln(os.Stderr, "Running", binary)
+	}
+
+	// An interrupt from the terminal reaches the program as well; it
+	// writes its profiles and terminates. We stay alive to print the
+	// summary. SIGTERM is passed on to the program.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	if err := program.Start(); err != nil {
+		return err
+	}
+	go func() {
+		for sig := range sigs {
+			if sig != os.Interrupt {
+				program.Process.Signal(sig)
+			}
+		}
+	}()
+
+	err := program.Wait()
+	exitErr, ok := err.(*exec.ExitError)
+	if err != nil && !ok {
+		return err
+	}
+
+	if options.Top > 0 && len(options.Profiles) > 0 {
+		if err := printSummary(binary, proffile); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to print profile summary:", err)
+		}
+	}
+
+	if ok {
+		code := exitErr.ExitCode()
+		if status, isStatus := exitErr.Sys().(syscall.WaitStatus); isStatus && status.Signaled() {
+			// terminated by a signal, reported like shells do
+			code = 128 + int(status.Signal())
+		} else if code < 0 {
+			code = 1
+		}
+		return programExit{code}
+	}
+	return nil
+}
+
+// printSummary prints a report of the first selected profile to stderr.
+func printSummary(binary, proffile string) error {
+	if options.Interval > 0 || options.ToggleSignal != "" || profilePathOverridden(proffile, options.Profiles[0]) {
+		fmt.Fprintln(os.Stderr, "\nProfile path depends on the time, the environment or placeholders; not printing a summary.")
+		return nil
+	}
+	profile := profilePath(proffile, options.Profiles[0])
+	fmt.Fprintf(os.Stderr, "\nProfile %s:\n", profile)
+	return reportFile(os.Stderr, profile, binary)
+}
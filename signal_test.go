@@ -0,0 +1,135 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignal(t *testing.T) {
+	t.Parallel()
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		te := NewTestEnv(t, "temp_test-hello-signal")
+		te.SetEnv("GOPATH", te.Abs("../test/gopath"))
+		te.Run("./goprofile", "-profiles", "cpu,heap", "hello/sleep")
+
+		cmd := exec.Command(filepath.Join(te.Abs("."), "sleep.profile"))
+		cmd.Dir = te.wd
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		// wait until main() runs
+		if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "Sleeping world!\n" {
+			t.Fatalf("Unexpected output %#v (%v)", line, err)
+		}
+		cmd.Process.Signal(sig)
+		err = cmd.Wait()
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatalf("Expected program to be terminated by %s, got %v", sig, err)
+		}
+		if status := exitErr.Sys().(syscall.WaitStatus); !status.Signaled() || status.Signal() != sig {
+			t.Fatalf("Expected program to be terminated by %s, got %v", sig, status)
+		}
+		te.CheckNotEmpty("sleep.pprof")
+		te.CheckNotEmpty("sleep.heap.pprof")
+		te.Dispose()
+	}
+}
+
+func TestSignalIgnored(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-signal-ignored")
+	te.SetEnv("GOPATH", te.Abs("../test/gopath"))
+	te.Run("./goprofile", "hello/sleep")
+
+	// The shell execs the program with SIGINT ignored, like nohup does.
+	cmd := exec.Command("sh", "-c", "trap '' INT; exec ./sleep.profile")
+	cmd.Dir = te.wd
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// wait until main() runs
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "Sleeping world!\n" {
+		t.Fatalf("Unexpected output %#v (%v)", line, err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	cmd.Process.Signal(syscall.SIGINT)
+	select {
+	case err := <-exited:
+		t.Fatalf("Expected program to ignore SIGINT, but it exited (%v)", err)
+	case <-time.After(2 * time.Second):
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	err = <-exited
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("Expected program to be terminated by SIGTERM, got %v", err)
+	}
+	if status := exitErr.Sys().(syscall.WaitStatus); !status.Signaled() || status.Signal() != syscall.SIGTERM {
+		t.Fatalf("Expected program to be terminated by SIGTERM, got %v", status)
+	}
+	te.CheckNotEmpty("sleep.pprof")
+	te.Dispose()
+}
+
+func TestToggle(t *testing.T) {
+	t.Parallel()
+	te := NewTestEnv(t, "temp_test-hello-toggle")
+	te.SetEnv("GOPATH", te.Abs("../test/gopath"))
+	te.RunFailing(1, "./goprofile", "-toggle", "-profiles", "heap", "hello/sleep")
+	te.Run("./goprofile", "-toggle", "-togglesignal", "USR2", "-profiles", "cpu,mutex", "hello/sleep")
+
+	cmd := exec.Command(filepath.Join(te.Abs("."), "sleep.profile"))
+	cmd.Dir = te.wd
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// wait until main() runs
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "Sleeping world!\n" {
+		t.Fatalf("Unexpected output %#v (%v)", line, err)
+	}
+	// Signals received in the same second don't overwrite each other's files.
+	cmd.Process.Signal(syscall.SIGUSR2)
+	time.Sleep(200 * time.Millisecond)
+	cmd.Process.Signal(syscall.SIGUSR2)
+	time.Sleep(200 * time.Millisecond)
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Wait()
+
+	for pattern, count := range map[string]int{
+		"sleep.2*.pprof":           1,
+		"sleep.heap.2*.pprof":      2,
+		"sleep.goroutine.2*.pprof": 2,
+		"sleep.mutex.2*.pprof":     2,
+	} {
+		matches, err := filepath.Glob(filepath.Join(te.wd, pattern))
+		if err != nil || len(matches) != count {
+			t.Fatalf("Expected %d files matching %s, got %v (%v)", count, pattern, matches, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(te.wd, "sleep.pprof")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the cpu profile not to be collected from the start (%v)", err)
+	}
+	te.Dispose()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lorenzb/goprofile/instrument"
+)
+
+// profileKinds lists the profile kinds accepted by the -profiles flag.
+// Apart from "cpu", each kind is the name of a profile known to
+// pprof.Lookup.
+var profileKinds = []string{"cpu", "heap", "allocs", "block", "mutex", "goroutine", "threadcreate"}
+
+// parseProfiles parses a comma separated list of profile kinds,
+// e.g. "cpu,heap,mutex". "none" selects no profiles at all.
+func parseProfiles(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "none" {
+		return nil, nil
+	}
+	var kinds []string
+	for _, kind := range strings.Split(list, ",") {
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			continue
+		}
+		known := false
+		for _, k := range profileKinds {
+			if kind == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown profile kind '%s' (valid kinds: %s)",
+				kind, strings.Join(profileKinds, ", "))
+		}
+		kinds = append(kinds, kind)
+	}
+	if len(kinds) == 0 {
+		return nil, fmt.Errorf("no profile kinds given")
+	}
+	return kinds, nil
+}
+
+// profilePath returns the path the instrumented binary writes the profile of
+// the given kind to, given the path passed with -p. It mirrors goprofilePath
+// in the support file, except for the overrides from the environment and the
+// expansion of placeholders (see profilePathOverridden).
+func profilePath(proffile, kind string) string {
+	if kind == "cpu" {
+		return proffile
+	}
+	ext := filepath.Ext(proffile)
+	if kind == "trace" {
+		return strings.TrimSuffix(proffile, ext) + ".trace"
+	}
+	return strings.TrimSuffix(proffile, ext) + "." + kind + ext
+}
+
+// parseSize parses a size given on the command line,
+// e.g. "1024", "512kB", "100MB" or "2GB".
+func parseSize(size string) (int64, error) {
+	s, factor := size, int64(1)
+	for _, unit := range []struct {
+		suffix string
+		factor int64
+	}{{"kB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, factor = strings.TrimSuffix(s, unit.suffix), unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", size)
+	}
+	return n * factor, nil
+}
+
+// toggleSignals lists the signals that can be used with -togglesignal.
+var toggleSignals = []string{"SIGUSR1", "SIGUSR2", "SIGHUP"}
+
+// parseToggleSignal parses a signal name given with -togglesignal,
+// e.g. "USR1" or "SIGUSR1", and returns its name in package syscall.
+func parseToggleSignal(name string) (string, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	for _, sig := range toggleSignals {
+		if name == sig {
+			return sig, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported signal '%s' (supported signals: %s)", name, strings.Join(toggleSignals, ", "))
+}
+
+// profilePathOverridden determines whether the path of the profile of the
+// given kind is overridden by the environment or contains placeholders, such
+// that profilePath doesn't know where the instrumented binary writes it.
+func profilePathOverridden(proffile, kind string) bool {
+	return os.Getenv("GOPROFILE_"+strings.ToUpper(kind)+"_OUT") != "" ||
+		os.Getenv("GOPROFILE_OUT") != "" ||
+		strings.Contains(proffile, "{")
+}
+
+// newSupportConfig returns the configuration of the support file of the
+// instrumented package ipkg corresponding to the command line options, with
+// the cpu profile written to proffile.
+func newSupportConfig(ipkg *instrument.Package, proffile string) instrument.SupportConfig {
+	// Don't interfere with programs that handle signals themselves.
+	if ipkg.HandlesSignals && options.Verbose {
+		fmt.Fprintln(os.Stderr, "Program imports os/signal. Won't write profiles on SIGINT/SIGTERM.")
+	}
+	return instrument.SupportConfig{
+		Prefix:       ipkg.Prefix,
+		ProfFile:     proffile,
+		HTTP:         options.HTTP,
+		ToggleSignal: options.ToggleSignal,
+		CPURate:      options.CPURate,
+		Delay:        options.Delay,
+		Duration:     options.Duration,
+		Interval:     options.Interval,
+		Keep:         options.Keep,
+		KeepSize:     options.KeepSize,
+		Profiles:     options.Profiles,
+		Trace:        options.Trace,
+		Signals:      !ipkg.HandlesSignals,
+	}
+}
+
+// writeSupportFile writes the support file to the given path.
+// Unless overwrite is set, it is an error if the file already exists.
+func writeSupportFile(path string, config instrument.SupportConfig, overwrite bool) error {
+	src, err := instrument.SupportSource(config)
+	if err != nil {
+		return err
+	}
+	return writeGenerated(path, src, "support file", overwrite)
+}
+
+// writeGenerated writes the generated source src, described by what, to
+// the given path. Unless overwrite is set, it is an error if the file
+// already exists.
+func writeGenerated(path string, src []byte, what string, overwrite bool) error {
+	flag := os.O_CREATE | os.O_WRONLY | os.O_EXCL
+	if overwrite {
+		flag = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+	outFile, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to create %s: %s", what, err)
+	}
+	defer outFile.Close()
+	if _, err := outFile.Write(src); err != nil {
+		return fmt.Errorf("Failed to write %s: %s", what, err)
+	}
+	return nil
+}
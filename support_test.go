@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProfiles(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		list     string
+		expected []string
+		err      bool
+	}{
+		{"cpu", []string{"cpu"}, false},
+		{"cpu,heap, mutex", []string{"cpu", "heap", "mutex"}, false},
+		{"heap,", []string{"heap"}, false},
+		{"cpu,disk", nil, true},
+		{"", nil, true},
+		{"none", nil, false},
+	} {
+		kinds, err := parseProfiles(test.list)
+		if (err != nil) != test.err {
+			t.Fatalf("%q: unexpected error value %v", test.list, err)
+		}
+		if strings.Join(kinds, ",") != strings.Join(test.expected, ",") {
+			t.Fatalf("%q: expected %v, got %v", test.list, test.expected, kinds)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		size     string
+		expected int64
+		err      bool
+	}{
+		{"1024", 1024, false},
+		{"10B", 10, false},
+		{"512kB", 512 << 10, false},
+		{"100MB", 100 << 20, false},
+		{"2GB", 2 << 30, false},
+		{"MB", 0, true},
+		{"-1", 0, true},
+		{"1TB", 0, true},
+	} {
+		size, err := parseSize(test.size)
+		if (err != nil) != test.err {
+			t.Fatalf("%q: unexpected error value %v", test.size, err)
+		}
+		if size != test.expected {
+			t.Fatalf("%q: expected %d, got %d", test.size, test.expected, size)
+		}
+	}
+}
+
+func TestParseToggleSignal(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		name     string
+		expected string
+		err      bool
+	}{
+		{"USR1", "SIGUSR1", false},
+		{"sigusr2", "SIGUSR2", false},
+		{"SIGHUP", "SIGHUP", false},
+		{"KILL", "", true},
+	} {
+		sig, err := parseToggleSignal(test.name)
+		if (err != nil) != test.err {
+			t.Fatalf("%q: unexpected error value %v", test.name, err)
+		}
+		if sig != test.expected {
+			t.Fatalf("%q: expected %s, got %s", test.name, test.expected, sig)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// main keeps the cpu busy for a few seconds.
+func main() {
+	var n uint64
+	for start := time.Now(); time.Since(start) < 3500*time.Millisecond; {
+		n = n*6364136223846793005 + 1442695040888963407
+	}
+	fmt.Println("Busy world!", n != 0)
+}
@@ -0,0 +1,8 @@
+package main
+
+import "log"
+
+func fatal(msg string) {
+	log.SetFlags(0)
+	log.Fatalln(msg)
+}
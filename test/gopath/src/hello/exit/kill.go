@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// kill terminates the program the way a signal from outside would, without
+// giving it a chance to write its profiles.
+func kill() {
+	p, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		p.Kill()
+	}
+	time.Sleep(time.Minute)
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "-kill" {
+		kill()
+	}
+	if len(os.Args) > 1 {
+		fatal(os.Args[1])
+	}
+	fmt.Println("Goodbye world!")
+	exit(3)
+}
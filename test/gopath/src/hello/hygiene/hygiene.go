@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	stdos "os"
+)
+
+// The following declarations collide with names that the code
+// added by goprofile would use if it wasn't careful.
+var os = "not the os package"
+
+var goprofileStart = false
+
+func trace(msg string) {
+	fmt.Println(msg)
+}
+
+var log = trace
+
+func main() {
+	log("Hygienic world!")
+	stdos.Exit(0)
+}
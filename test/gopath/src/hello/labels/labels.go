@@ -0,0 +1,21 @@
+package main
+
+import "fmt"
+
+type server struct {
+	started chan bool
+}
+
+// handle blocks forever, so that it shows up in the goroutine profile
+// written when main returns.
+func (s *server) handle() {
+	s.started <- true
+	select {}
+}
+
+func main() {
+	s := &server{started: make(chan bool)}
+	go s.handle()
+	<-s.started
+	fmt.Println("Labeled world!")
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/pprof"
+)
+
+func inner() {}
+
+// outer blocks forever after calling inner, so that it shows up in the
+// goroutine profile written when main returns.
+func outer(started chan bool) {
+	inner()
+	started <- true
+	select {}
+}
+
+// request blocks forever after calling inner, with the labels set by pprof.Do.
+func request(started chan bool) {
+	pprof.Do(context.Background(), pprof.Labels("request", "1"), func(context.Context) {
+		inner()
+		started <- true
+		select {}
+	})
+}
+
+func main() {
+	started := make(chan bool)
+	go outer(started)
+	go request(started)
+	<-started
+	<-started
+	fmt.Println("Nested world!")
+}
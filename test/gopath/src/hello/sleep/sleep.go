@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+func main() {
+	fmt.Println("Sleeping world!")
+	time.Sleep(time.Minute)
+}
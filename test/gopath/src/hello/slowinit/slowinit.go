@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// seed is computed when the package is initialized, before main() runs,
+// keeping the cpu busy for a second.
+var seed = spin(time.Second)
+
+func spin(d time.Duration) uint64 {
+	var n uint64
+	for start := time.Now(); time.Since(start) < d; {
+		n = n*6364136223846793005 + 1442695040888963407
+	}
+	return n
+}
+
+func main() {
+	fmt.Println("Initialized world!", seed != 0)
+}
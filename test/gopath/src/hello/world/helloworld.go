@@ -1,3 +1,4 @@
+//go:build !german
 // +build !german
 
 package main
@@ -0,0 +1,15 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+)
+
+//go:embed greeting.txt
+var greeting string
+
+func main() {
+	fmt.Print(greeting)
+	os.Exit(0)
+}
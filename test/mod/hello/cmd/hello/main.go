@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+
+	"example.com/hello/internal/greeting"
+)
+
+func main() {
+	fmt.Println(greeting.Greeting())
+}
@@ -0,0 +1,7 @@
+module example.com/hello
+
+go 1.16
+
+require example.com/polite v0.0.0
+
+replace example.com/polite => ../polite
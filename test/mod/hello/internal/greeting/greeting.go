@@ -0,0 +1,7 @@
+package greeting
+
+import "example.com/polite"
+
+func Greeting() string {
+	return polite.Greet("module world")
+}
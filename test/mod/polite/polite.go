@@ -0,0 +1,5 @@
+package polite
+
+func Greet(name string) string {
+	return "Greetings, " + name + "!"
+}
@@ -0,0 +1,3 @@
+module example.com/slowimport
+
+go 1.18
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+
+	"example.com/slowimport/seed"
+)
+
+func main() {
+	fmt.Println("Initialized world!", seed.Seed != 0)
+}
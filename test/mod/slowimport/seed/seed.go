@@ -0,0 +1,16 @@
+package seed
+
+import "time"
+
+// Seed is computed when the package is initialized, before main() runs,
+// keeping the cpu busy for a second. The package only imports time, so it
+// can be initialized before e.g. os.
+var Seed = spin(time.Second)
+
+func spin(d time.Duration) uint64 {
+	var n uint64
+	for start := time.Now(); time.Since(start) < d; {
+		n = n*6364136223846793005 + 1442695040888963407
+	}
+	return n
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lorenzb/goprofile/instrument"
+)
+
+// isTool determines whether the first positional command line argument
+// names a go tool, i.e. whether goprofile was run by the go command with
+// -toolexec (e.g. go build -toolexec=goprofile ./...). The go command passes
+// the absolute path of the tool (e.g. $GOROOT/pkg/tool/linux_amd64/compile),
+// which can't be mistaken for the source files or package goprofile is
+// usually given.
+func isTool(arg string) bool {
+	if !filepath.IsAbs(arg) || strings.HasSuffix(arg, ".go") {
+		return false
+	}
+	fi, err := os.Stat(arg)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// toolexec implements 'go build -toolexec=goprofile': it runs the go tool
+// options.Tool with the arguments options.ToolArgs. The compiler is given
+// instrumented copies of the files of main packages and the support file,
+// and the compiler and the linker are given the packages the support file
+// imports. Everything else is passed through unchanged.
+func toolexec() error {
+	name := strings.TrimSuffix(filepath.Base(options.Tool), ".exe")
+	args := options.ToolArgs
+	var err error
+	switch {
+	case (name == "compile" || name == "link") && len(args) == 1 && args[0] == "-V=full":
+		return toolVersion()
+	case name == "compile" && flagValue(args, "-p") == "main":
+		args, err = instrumentCompile(args)
+	case name == "link":
+		args, err = addSupportImports(args, filepath.Join(filepath.Dir(flagValue(args, "-importcfg")), "goprofile"))
+	}
+	if err != nil {
+		return err
+	}
+	err = runTool(args)
+	if err != nil && name == "link" {
+		linkHint(args)
+	}
+	return err
+}
+
+// linkHint explains a failed link with the arguments args if the build tags
+// the go command recorded differ from those the compiler's support imports
+// were built with, e.g. because the command line of the go command couldn't
+// be read: packages added to the compiler's importcfg were then built with
+// other tags than those the linker is given, which it reports as a
+// fingerprint mismatch.
+func linkHint(args []string) {
+	cfg, err := ioutil.ReadFile(flagValue(args, "-importcfg"))
+	if err != nil {
+		return
+	}
+	tags := buildSettings(cfg)["-tags"]
+	given, found := goCommandSettings(parentArgs())["-tags"]
+	if !found {
+		given = flagValue(options.BuildFlags, "-tags")
+	}
+	if given == "" {
+		given = flagValue(strings.Fields(os.Getenv("GOFLAGS")), "-tags")
+	}
+	split := func(r rune) bool { return r == ',' || r == ' ' }
+	if strings.Join(strings.FieldsFunc(given, split), ",") != tags {
+		fmt.Fprintf(os.Stderr, "goprofile: the program was built with -tags %q. Give goprofile the same tags, e.g. -toolexec='goprofile -buildflags \"-tags %s\"'.\n", tags, tags)
+	}
+}
+
+// runTool runs options.Tool with the given arguments, passing through stdin,
+// stdout and stderr. If the tool fails, goprofile exits with its exit code.
+func runTool(args []string) error {
+	tool := exec.Command(options.Tool, args...)
+	tool.Stdin = os.Stdin
+	tool.Stdout = os.Stdout
+	tool.Stderr = os.Stderr
+	err := tool.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code := exitErr.ExitCode()
+		if code < 0 {
+			// terminated by a signal
+			code = 1
+		}
+		return programExit{code}
+	}
+	return err
+}
+
+// toolVersion prints the version of options.Tool like 'compile -V=full' does,
+// but with a hash of goprofile and its flags added. The go command identifies
+// the tool by its version in the keys of its build cache, so that instrumented
+// packages and binaries aren't mixed up with those built without goprofile or
+// with different flags.
+func toolVersion() error {
+	tool := exec.Command(options.Tool, options.ToolArgs...)
+	tool.Stderr = os.Stderr
+	out, err := tool.Output()
+	if err != nil {
+		return err
+	}
+	id, err := toolexecID()
+	if err != nil {
+		return err
+	}
+	line := strings.TrimSpace(string(out))
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.HasPrefix(fields[len(fields)-1], "buildID=") {
+		// Development versions are identified by their build ID,
+		// which has to come last.
+		fmt.Printf("%s-goprofile.%s\n", line, id)
+	} else {
+		fmt.Printf("%s goprofile=%s\n", line, id)
+	}
+	return nil
+}
+
+// toolexecID returns a hash of the goprofile executable and the flags it
+// was given before the path of the tool.
+func toolexecID() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	for _, arg := range os.Args[1:] {
+		if arg == options.Tool {
+			break
+		}
+		fmt.Fprintf(h, "%q\n", arg)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// flagValue returns the value of the flag name (e.g. "-p") in the tool
+// arguments args, or "" if it isn't given.
+func flagValue(args []string, name string) string {
+	for i, arg := range args {
+		if arg == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"=")
+		}
+	}
+	return ""
+}
+
+// setFlagValue returns args with the value of the flag name replaced by value.
+func setFlagValue(args []string, name, value string) []string {
+	args = append([]string{}, args...)
+	for i, arg := range args {
+		if arg == name && i+1 < len(args) {
+			args[i+1] = value
+			break
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			args[i] = name + "=" + value
+			break
+		}
+	}
+	return args
+}
+
+// toolexecName returns the name the go command gives to the binary built
+// from the main package being compiled (without the .exe extension), i.e.
+// the last element of its import path, which the go command passes in the
+// environment variable TOOLEXEC_IMPORTPATH. Binaries built from files given
+// on the command line are named after the first one.
+func toolexecName(files []string) string {
+	importPath := os.Getenv("TOOLEXEC_IMPORTPATH")
+	// test variants are described as e.g. "example.com/app [example.com/app.test]"
+	if i := strings.Index(importPath, " "); i >= 0 {
+		importPath = importPath[:i]
+	}
+	if importPath == "" || importPath == "command-line-arguments" {
+		return strings.TrimSuffix(filepath.Base(files[0]), ".go")
+	}
+	elem := path.Base(importPath)
+	if elem != importPath && majorVersionSuffix.MatchString(elem) {
+		elem = path.Base(path.Dir(importPath))
+	}
+	return elem
+}
+
+// instrumentCompile returns the compiler arguments args for a main package
+// with the go files replaced by their instrumented copies and the support
+// file added. These are written to the directory "goprofile" next to the
+// compiler's output, in the object directory the go command removes after
+// the build.
+func instrumentCompile(args []string) ([]string, error) {
+	// the go files come last
+	first := len(args)
+	for first > 0 && strings.HasSuffix(args[first-1], ".go") {
+		first--
+	}
+	if first == len(args) {
+		return args, nil
+	}
+	files := args[first:]
+
+	ipkg, err := instrumentFiles(files)
+	if err == instrument.ErrNoMain {
+		return args, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(filepath.Dir(flagValue(args, "-o")), "goprofile")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	newArgs := append([]string{}, args[:first]...)
+	// Files generated by an earlier run with -inplace are left out.
+	for _, f := range ipkg.Files {
+		path := f.Path
+		if f.Changed() {
+			path = filepath.Join(dir, filepath.Base(f.Path))
+			if err := writeGenerated(path, f.Source, "instrumented copy", true); err != nil {
+				return nil, err
+			}
+			if f.Main && options.Verbose {
+				fmt.Fprintf(os.Stderr, "Found and instrumented main() function in %s.\n", f.Path)
+			}
+		}
+		newArgs = append(newArgs, path)
+	}
+
+	config := newSupportConfig(ipkg, profFile(toolexecName(files)))
+	support := filepath.Join(dir, instrument.SupportFileName(ipkg.Prefix))
+	if err := writeSupportFile(support, config, true); err != nil {
+		return nil, err
+	}
+	newArgs = append(newArgs, support)
+	if options.Verbose {
+		fmt.Fprintln(os.Stderr, "Instrumented executable will save", strings.Join(options.Profiles, ", "), "profiles based on", config.ProfFile)
+	}
+
+	return addSupportImports(newArgs, dir)
+}
+
+// addSupportImports returns the compiler or linker arguments args with the
+// packages imported by the support file (and their dependencies) added to
+// the file given with -importcfg, which maps import paths to the files the
+// packages were compiled to. The go command only lists the dependencies of
+// the program, which might not include e.g. runtime/pprof. The packages are
+// built with 'go list -export', and the new file is written to dir.
+func addSupportImports(args []string, dir string) ([]string, error) {
+	importcfg := flagValue(args, "-importcfg")
+	if importcfg == "" {
+		return args, nil
+	}
+	cfg, err := ioutil.ReadFile(importcfg)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(cfg))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "packagefile" {
+			listed[strings.SplitN(fields[1], "=", 2)[0]] = true
+		}
+	}
+
+	// The imports don't depend on the package or the profile path.
+	src, err := instrument.SupportSource(newSupportConfig(&instrument.Package{Prefix: instrument.DefaultPrefix}, ""))
+	if err != nil {
+		return nil, err
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ImportsOnly)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return nil, err
+		}
+		// unsafe isn't compiled to a file
+		if !listed[path] && path != "unsafe" {
+			missing = append(missing, path)
+		}
+	}
+	if len(missing) == 0 {
+		return args, nil
+	}
+
+	// The compiler's importcfg has no build settings.
+	settings := goCommandSettings(parentArgs())
+	for name, value := range buildSettings(cfg) {
+		settings[name] = value
+	}
+	listArgs := append(toolBuildFlags(args, settings), "-export", "-deps")
+	pkgs, err := listPackages(append(listArgs, missing...)...)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(cfg)
+	if len(cfg) > 0 && cfg[len(cfg)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	for _, pkg := range pkgs {
+		if !listed[pkg.ImportPath] && pkg.Export != "" {
+			fmt.Fprintf(&buf, "packagefile %s=%s\n", pkg.ImportPath, pkg.Export)
+		}
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	newImportcfg := filepath.Join(dir, filepath.Base(importcfg))
+	if err := ioutil.WriteFile(newImportcfg, buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	return setFlagValue(args, "-importcfg", newImportcfg), nil
+}
+
+// toolBuildFlags returns the flags of the build the go command runs the
+// compiler or linker for, with the arguments args and the build settings
+// settings (see buildSettings and goCommandSettings), that go list must be
+// given to build the packages added by addSupportImports like the others.
+// -race, -msan and -asan are passed to the tools as they are. -trimpath is
+// passed to the compiler as a rewrite of the package directory, its working
+// directory. The compiler isn't told the build tags.
+func toolBuildFlags(args []string, settings map[string]string) []string {
+	var flags []string
+	for _, arg := range args {
+		if arg == "-race" || arg == "-msan" || arg == "-asan" {
+			flags = append(flags, arg)
+		}
+	}
+	trimpath := settings["-trimpath"] == "true"
+	if dir, err := os.Getwd(); err == nil && strings.HasPrefix(flagValue(args, "-trimpath"), dir+"=>") {
+		trimpath = true
+	}
+	if trimpath {
+		flags = append(flags, "-trimpath")
+	}
+	if tags, ok := settings["-tags"]; ok {
+		flags = append(flags, "-tags="+tags)
+	}
+	return flags
+}
+
+// parentArgs returns the command line of the process that started goprofile,
+// i.e. of the go command with -toolexec, or nil if the operating system
+// doesn't expose it. Only Linux does, in /proc.
+func parentArgs() []string {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", os.Getppid()))
+	if err != nil || len(cmdline) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+}
+
+// goBoolFlags are the boolean flags of the go command and its build and test
+// flags, which aren't followed by a value.
+var goBoolFlags = map[string]bool{
+	"a": true, "asan": true, "benchmem": true, "buildvcs": true, "c": true,
+	"cover": true, "failfast": true, "i": true, "json": true, "linkshared": true,
+	"modcacherw": true, "msan": true, "n": true, "race": true, "short": true,
+	"trimpath": true, "v": true, "work": true, "x": true,
+}
+
+// goCommandSettings returns the build settings -tags and -trimpath, as
+// buildSettings does, given to the go command with the command line args
+// (e.g. go build -tags netgo ./cmd/app). Its flags precede the packages.
+// Settings given with GOFLAGS aren't included; go list reads them as well.
+func goCommandSettings(args []string) map[string]string {
+	settings := make(map[string]string)
+	if len(args) < 2 {
+		return settings
+	}
+	// the go command and its subcommand
+	args = args[2:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		name, value := strings.TrimLeft(arg, "-"), ""
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, value = name[:eq], name[eq+1:]
+		} else if !goBoolFlags[name] && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		switch name {
+		case "tags":
+			split := func(r rune) bool { return r == ',' || r == ' ' }
+			settings["-tags"] = strings.Join(strings.FieldsFunc(value, split), ",")
+		case "trimpath":
+			if value == "" {
+				value = "true"
+			}
+			if trimpath, err := strconv.ParseBool(value); err == nil {
+				settings["-trimpath"] = strconv.FormatBool(trimpath)
+			}
+		}
+	}
+	return settings
+}
+
+// buildSettings returns the build settings (e.g. "-tags" and "-trimpath") in
+// the module information the go command adds to the linker's importcfg cfg,
+// which 'go version -m' prints for the binary.
+func buildSettings(cfg []byte) map[string]string {
+	settings := make(map[string]string)
+	for _, line := range strings.Split(string(cfg), "\n") {
+		if !strings.HasPrefix(line, "modinfo ") {
+			continue
+		}
+		info, err := strconv.Unquote(strings.TrimPrefix(line, "modinfo "))
+		if err != nil {
+			continue
+		}
+		for _, l := range strings.Split(info, "\n") {
+			if setting := strings.TrimPrefix(l, "build\t"); setting != l {
+				if kv := strings.SplitN(setting, "=", 2); len(kv) == 2 {
+					settings[kv[0]] = kv[1]
+				}
+			}
+		}
+	}
+	return settings
+}
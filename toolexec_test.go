@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFlagValue(t *testing.T) {
+	t.Parallel()
+	args := []string{"-o", "$WORK/b001/_pkg_.a", "-p", "main", "-importcfg=$WORK/b001/importcfg", "main.go"}
+	for name, expected := range map[string]string{
+		"-p":         "main",
+		"-importcfg": "$WORK/b001/importcfg",
+		"-trimpath":  "",
+	} {
+		if value := flagValue(args, name); value != expected {
+			t.Fatalf("%s: expected %q, got %q", name, expected, value)
+		}
+	}
+
+	replaced := setFlagValue(setFlagValue(args, "-p", "other"), "-importcfg", "cfg")
+	if strings.Join(replaced, " ") != "-o $WORK/b001/_pkg_.a -p other -importcfg=cfg main.go" {
+		t.Fatalf("Unexpected arguments %v", replaced)
+	}
+	if args[3] != "main" {
+		t.Fatal("Expected setFlagValue not to modify its argument")
+	}
+}
+
+func TestToolexecName(t *testing.T) {
+	defer os.Setenv("TOOLEXEC_IMPORTPATH", os.Getenv("TOOLEXEC_IMPORTPATH"))
+	for _, test := range []struct {
+		importPath, expected string
+	}{
+		{"example.com/app/cmd/server", "server"},
+		{"example.com/app/v2", "app"},
+		{"v2", "v2"},
+		{"example.com/app.test", "app.test"},
+		{"example.com/app [example.com/app.test]", "app"},
+		{"command-line-arguments", "main"},
+		{"", "main"},
+	} {
+		os.Setenv("TOOLEXEC_IMPORTPATH", test.importPath)
+		if name := toolexecName([]string{"/src/main.go", "/src/util.go"}); name != test.expected {
+			t.Fatalf("%q: expected %s, got %s", test.importPath, test.expected, name)
+		}
+	}
+}
+
+func TestToolBuildFlags(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := "0w\xaf\f\x92t\b\x02A\xe1\xc1\a\xe6\xd6\x18\xe6path\texample.com/app\n" +
+		"build\t-compiler=gc\nbuild\t-tags=netgo,osusergo\nbuild\t-trimpath=true\nbuild\tGOOS=linux\n"
+	linkcfg := []byte("packagefile example.com/app=$WORK/b001/_pkg_.a\nmodinfo " + strconv.Quote(info) + "\n")
+	for _, test := range []struct {
+		args     []string
+		cfg      []byte
+		expected string
+	}{
+		{[]string{"-p", "main", "-trimpath", "$WORK/b001=>", "main.go"}, nil, ""},
+		{[]string{"-p", "main", "-race", "-trimpath", dir + "=>example.com/app;$WORK/b001=>", "main.go"}, nil, "-race -trimpath"},
+		{[]string{"-o", "$WORK/b001/exe/a.out", "-importcfg", "$WORK/b001/importcfg.link", "-msan"}, linkcfg, "-msan -trimpath -tags=netgo,osusergo"},
+		{[]string{"-o", "$WORK/b001/exe/a.out"}, []byte("packagefile example.com/app=$WORK/b001/_pkg_.a\n"), ""},
+	} {
+		if flags := strings.Join(toolBuildFlags(test.args, buildSettings(test.cfg)), " "); flags != test.expected {
+			t.Fatalf("%v: expected %q, got %q", test.args, test.expected, flags)
+		}
+	}
+}
+
+func TestGoCommandSettings(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"go", "build", "-toolexec", "goprofile", "./cmd/app"}, "map[]"},
+		{[]string{"go", "build", "-tags", "netgo osusergo", "-trimpath", "-o", "app", "./cmd/app"}, "map[-tags:netgo,osusergo -trimpath:true]"},
+		{[]string{"go", "test", "-v", "--tags=netgo", "-count", "1", "-trimpath=false", "."}, "map[-tags:netgo -trimpath:false]"},
+		// flags of the program run
+		{[]string{"go", "run", "-race", "./cmd/app", "-tags", "netgo"}, "map[]"},
+		{[]string{"sh", "-c", "go build -tags netgo"}, "map[]"},
+		{nil, "map[]"},
+	} {
+		if settings := fmt.Sprint(goCommandSettings(test.args)); settings != test.expected {
+			t.Fatalf("%v: expected %s, got %s", test.args, test.expected, settings)
+		}
+	}
+}